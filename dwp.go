@@ -1,128 +1,4447 @@
+//go:build !tpm
+
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"maps"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/language"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Exit status, so scripts can tell failures apart without parsing stderr
+const (
+	exitFailure    = 1 // output, keyring or other failure
+	exitUsage      = 2 // invalid arguments, as for flag parse errors
+	exitDictionary = 3 // dictionary missing, malformed or too small
+	exitSource     = 4 // the random source failed
+	exitConstraint = 5 // the filters could not be satisfied
+	exitTimeout    = 6 // -timeout expired
 )
 
 func main() {
 	// Define command-line flags
 	rolls := flag.Int("r", 10, "number of Diceware numbers to generate")
-	dictFile := flag.String("d", "", "path to Diceware dictionary file")
+	maxRolls := flag.Int("max-rolls", 1000, "refuse -r above this, as a guard against typos")
+	var dictFiles []string
+	flag.Func("d", "path to Diceware dictionary file; repeat to draw the words from each list in turn", func(path string) error {
+		dictFiles = append(dictFiles, path)
+		return nil
+	})
+	splitFirst := flag.Bool("split-first", false, "split dictionary lines at the first space or tab only, keeping the rest as the word")
+	minDictSize := flag.Int("min-dict-size", 16, "refuse dictionaries with fewer words, which give dangerously little entropy (0 disables)")
+	poolSize := flag.Int("pool-size", 0, "use only the first n words of the dictionary, drawn by index instead of dice, at log2(n) bits each")
+	allowedHashes := flag.String("allowed-dict-hashes", "", "refuse dictionaries whose SHA-256 is not listed in this file")
+	checkWeak := flag.String("check-weak-dictionary", "warn", "compare the entropy of distinct words to the key count: off, warn or strict (fail)")
+	wordsFile := flag.String("words-file", "", "format the words in this file (one per line) like a passphrase instead of generating one")
+	dictSHA256 := flag.String("dict-sha256", "", "SHA-256 a dictionary downloaded with -d https://... must have; comma-separated for several")
+	dictEncoding := flag.String("dict-encoding", "utf-8", "character encoding of the dictionary file, e.g. iso-8859-1 or windows-1252")
+	normalize := flag.String("normalize", "NFC", "Unicode normalization form applied to dictionary words: NFC or NFKC")
+	normalizeDict := flag.String("normalize-dict", "", "write the -d list deduplicated, sorted and renumbered to this file and exit")
+	buildDict := flag.String("build-dict", "", "read words typed one per line and write them as a numbered dictionary to this new file, then exit")
+	dice := flag.Int("dice", 0, "dice per Diceware number (default: key width of the dictionary, else 5)")
 	showPassphrase := flag.Bool("p", false, "output complete passphrase")
+	chunk := flag.Int("chunk", 0, "with -p, also show the passphrase in groups of this many characters for copying by hand")
+	chunkSep := flag.String("chunk-sep", " ", "string between -chunk groups, which is not part of the passphrase")
 	separator := flag.String("s", " ", "separator for passphrase words (used with -p)")
+	sepPattern := flag.String("sep-pattern", "", "comma-separated separators used in turn between words, e.g. \" ,-\"")
+	sepFromWord := flag.String("sep-from-word", "", "separate words with the characters of this word in turn, e.g. \"pin\" gives one p two i three")
+	asciiOnly := flag.Bool("ascii-only", false, "re-roll words containing non-ASCII characters")
+	badSubstrings := flag.String("no-bad-substrings", "", "re-roll passphrases in which words join to form a string listed in this file")
+	weakWords := flag.String("weak-words", "", "re-roll words that appear in this list of common passwords (case-insensitive)")
+	policyExpr := flag.String("policy-expr", "", "discard passphrases failing this expression, e.g. \"bits >= 64 AND hasDigit\"")
+	minUnique := flag.Int("min-unique-chars", 0, "discard passphrases with fewer distinct characters than this, separators included")
+	showRerolls := flag.Bool("show-rerolls", false, "report on stderr how many words were re-rolled and passphrases discarded (also with -v)")
+	maxRetries := flag.Int("max-retries", 1000, "re-rolls allowed per word before giving up on the filters")
+	capitalize := flag.Bool("capitalize", false, "capitalize each word of the passphrase")
+	boundaryCase := flag.Bool("boundary-case", false, "alternate lower and upper case word by word, e.g. lowerUPPERlower")
+	lang := flag.String("lang", "en", "language tag for -capitalize casing rules, e.g. tr or de")
+	align := flag.Bool("align", false, "pad listed words to the longest dictionary word so columns line up")
+	format := flag.String("format", "text", "output format: text, json, csv or md")
+	jsonSchema := flag.Bool("json-schema", false, "print the JSON Schema of the -format json output and exit")
+	preview := flag.Bool("preview", false, "show the passphrase on the terminal and ask to accept, regenerate or quit")
+	stream := flag.Bool("stream", false, "show a fresh passphrase per Enter keypress on the terminal; a accepts, q quits")
+	compat := flag.String("compat", "", "match another generator's defaults and output: keepassxc")
+	label := flag.Bool("label", false, "print only a labeled line, \"dwp-passphrase-v1: <passphrase>\", for scripts")
+	sheet := flag.Bool("sheet", false, "print a numbered recovery sheet of the words and the passphrase")
+	backupCodes := flag.Int("backup-codes", 0, "also print this many one-time backup codes for account recovery")
+	backupCodeLen := flag.Int("backup-code-length", 10, "characters per -backup-codes code")
+	keyringName := flag.String("keyring", "", "store the passphrase in the kernel keyring under this name and print only the name")
+	keyringTTL := flag.Duration("keyring-ttl", 10*time.Minute, "expire the -keyring entry after this long (0 to keep it)")
+	keyringGet := flag.String("keyring-get", "", "print the passphrase stored under this keyring name and exit")
+	keyringClear := flag.String("keyring-clear", "", "remove the passphrase stored under this keyring name and exit")
+	outFile := flag.String("o", "", "write output to this file (mode 0600) instead of stdout")
+	tee := flag.Bool("tee", false, "with -o, write the output to stdout as well")
+	countAddons := flag.Bool("include-separators-in-entropy", false, "count -append-chars and other add-ons in the reported entropy, not just the words")
+	appendChars := flag.Int("append-chars", 0, "number of random characters to append to the passphrase")
+	exactLength := flag.Int("exact-length", 0, "cut or pad the passphrase with -append-alphabet characters to exactly this many characters, for legacy systems")
+	appendAlphabet := flag.String("append-alphabet", defaultAppendAlphabet, "characters to draw -append-chars from")
+	serve := flag.String("serve", "", "serve passphrases over HTTP on this address (a bare port binds to localhost) or unix:/path socket")
+	logFormat := flag.String("log-format", "", "write service and audit diagnostics as log/slog records: text or json")
+	serveRate := flag.Int("serve-rate", 60, "requests per minute allowed by -serve")
+	explain := flag.String("explain", "", "show how this Diceware number maps to a word in the loaded dictionary and exit")
+	explainRNG := flag.Bool("explain-rng", false, "print the rejection sampling threshold, acceptance probability and expected bytes for each range drawn from, and exit")
+	compare := flag.Bool("compare", false, "print the entropy for 4 to 10 words with the loaded dictionary and exit")
+	minimal := flag.Bool("minimal", false, "use the fewest words, up to -max-rolls, that meet -min-bits-enforce and -policy-expr")
+	showStrength := flag.Bool("strength", false, "print a strength label for the passphrase entropy to stderr")
+	showGuesses := flag.Bool("guesses", false, "print the entropy as decimal digits and as the exact number of possible passphrases to stderr")
+	colorStrength := flag.Bool("color-strength", false, "draw a strength bar for the passphrase entropy on stderr")
+	colorMode := flag.String("color", "auto", "color stderr output: auto (terminal without NO_COLOR), always or never")
+	charStats := flag.Bool("char-stats", false, "print the length and character classes of the passphrase as password meters see it, to stderr")
+	seenDBPath := flag.String("seen-db", "", "re-roll passphrases issued before, remembered as salted hashes in this file")
+	poolPath := flag.String("pool", "", "hand out the next unused passphrases from this pool file, made with -pool-fill")
+	poolFill := flag.Int("pool-fill", 0, "with -pool, create the pool file holding this many passphrases of -r words, and exit")
+	poolTake := flag.Int("pool-take", 1, "with -pool, passphrases to hand out per run")
+	auditLog := flag.String("audit-log", "", "append a JSON line about each generation (never the passphrase) to this file, or \"syslog\"")
+	syslogFacility := flag.String("syslog-facility", "auth", "facility for -audit-log syslog, e.g. auth, authpriv, daemon, user or local0-7")
+	syslogTag := flag.String("syslog-tag", "dwp", "tag for -audit-log syslog")
+	metaFD := flag.Int("meta-fd", 0, "write JSON metadata (entropy, word count, source) to this file descriptor, e.g. 3")
+	minRank := flag.Int("min-rank", 0, "re-roll words whose frequency rank (third dictionary column) is below this")
+	dumpEntropy := flag.Int("dump-entropy", 0, "write this many raw random bytes from the source to stdout and exit")
+	showIndex := flag.Bool("show-index", false, "list the 0-based position of each word among the dictionary keys in order")
+	pips := flag.Bool("pips", false, "list Diceware numbers as die faces (⚀-⚅) instead of digits")
+	phonetic := flag.String("phonetic", "", "spell listed words in the NATO alphabet: full or first (letter only)")
+	sourceName := flag.String("source", "crypto/rand", "randomness source: crypto/rand or devrandom (blocking /dev/random, Linux only)")
+	profile := flag.Bool("profile-entropy", false, "print a JSON report of a source self-test, the dictionary and a sample generation, then exit")
+	encryptIn := flag.String("encrypt", "", "encrypt this file with the new passphrase (scrypt, AES-256-GCM) into -encrypt-out")
+	decryptIn := flag.String("decrypt", "", "decrypt a file made by -encrypt into -encrypt-out, asking for the passphrase, and exit")
+	encryptOut := flag.String("encrypt-out", "", "file written by -encrypt or -decrypt; it must not exist yet")
+	deriveKey := flag.Int("derive-key", 0, "derive a key of this many bytes from the passphrase with HKDF-SHA256 and a random salt")
+	deriveEncoding := flag.String("derive-encoding", "hex", "encoding of the -derive-key salt and key: hex or base64")
+	deriveFD := flag.Int("derive-fd", 0, "file descriptor to write the -derive-key salt and key to, 3 or above")
+	minBits := flag.Float64("min-bits-enforce", 0, "fail instead of printing a passphrase with less entropy than this many bits")
+	secretIndex := flag.Uint64("secret-index", 0, "with -from-secret, derive passphrase number n of a reproducible series")
+	fromSecret := flag.Bool("from-secret", false, "derive the passphrase deterministically from a secret read from the terminal or stdin (not random!)")
+	paranoid := flag.Bool("paranoid", false, "strongest defaults: lock memory, self-test the source, require 80 bits (explicit flags win)")
+	noFileOutput := flag.Bool("no-file-output", false, "refuse -o, -tee, -meta-fd and -pool, which leave the passphrase or its details outside stdout")
+	showTimings := flag.Bool("timings", false, "report on stderr how long loading, opening the source and generating took")
+	printConfig := flag.Bool("print-config", false, "print the command line equivalent to the settings in effect, after @file arguments and presets, and exit")
+	verbose := flag.Bool("v", false, "report on stderr which dictionary file was used")
+	timeout := flag.Duration("timeout", 0, "abort if generation takes longer than this (e.g. 30s, 0 for no limit)")
+
+	// Parse command-line flags; arguments of the form @file are replaced
+	// by the arguments in file
+	args, err := expandResponseFiles(os.Args[1:], nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	flag.CommandLine.Parse(args)
+
+	if *jsonSchema {
+		fmt.Print(outputSchema)
+		return
+	}
+
+	// Decrypting needs the passphrase, not a new one
+	if *decryptIn != "" {
+		if *encryptOut == "" {
+			fmt.Fprintf(os.Stderr, "Error: -decrypt requires -encrypt-out\n")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		passphrase, err := readSecret("Passphrase: ")
+		if err == nil {
+			err = decryptFile(*decryptIn, *encryptOut, passphrase)
+			clear(passphrase)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error decrypting %s: %v\n", *decryptIn, err)
+			os.Exit(exitFailure)
+		}
+		return
+	}
+
+	// Keyring retrieval and removal don't generate anything
+	if *keyringGet != "" {
+		secret, err := keyringRead(*keyringGet)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading keyring: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		fmt.Println(secret)
+		return
+	}
+	if *keyringClear != "" {
+		if err := keyringRemove(*keyringClear); err != nil {
+			fmt.Fprintf(os.Stderr, "Error clearing keyring: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		return
+	}
 
-	// Parse command-line flags
-	flag.Parse()
+	// Without -d, fall back to a wordlist installed separately
+	dictPath := findDictionary()
+	if len(dictFiles) > 0 {
+		dictPath = dictFiles[0]
+	}
 
 	// Check for invalid input
 	if *rolls < 1 {
 		fmt.Fprintf(os.Stderr, "Error: Number of rolls must be at least 1\n")
 		printUsage()
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+	if *tee && *outFile == "" {
+		fmt.Fprintf(os.Stderr, "Error: -tee requires -o\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *chunk < 0 {
+		fmt.Fprintf(os.Stderr, "Error: Chunk size must not be negative\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *rolls > *maxRolls && !*minimal {
+		fmt.Fprintf(os.Stderr, "Error: %d rolls exceed -max-rolls %d; raise it if you really mean it\n", *rolls, *maxRolls)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *format != "text" && *format != "json" && *format != "csv" && *format != "md" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown output format %q\n", *format)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	switch *logFormat {
+	case "":
+	case "text":
+		structuredLog = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	case "json":
+		structuredLog = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Unknown log format %q\n", *logFormat)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *serve != "" && (dictPath == "" || *serveRate < 1) {
+		fmt.Fprintf(os.Stderr, "Error: -serve requires a dictionary (-d) and a -serve-rate of at least 1\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *stream && (*preview || *serve != "" || *wordsFile != "") {
+		fmt.Fprintf(os.Stderr, "Error: -stream cannot be combined with -preview, -serve or -words-file\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *stream && (!isTerminal(os.Stdin) || !isTerminal(os.Stderr)) {
+		fmt.Fprintf(os.Stderr, "Error: -stream requires a terminal\n")
+		os.Exit(exitUsage)
+	}
+	if *preview && (!isTerminal(os.Stdin) || !isTerminal(os.Stderr)) {
+		fmt.Fprintf(os.Stderr, "Error: -preview requires a terminal\n")
+		os.Exit(exitUsage)
+	}
+	if *label && (*format != "text" || *sheet) {
+		fmt.Fprintf(os.Stderr, "Error: -label cannot be combined with -format or -sheet\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *sheet && dictPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -sheet requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *keyringName != "" && dictPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -keyring requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	langTag, err := language.Parse(*lang)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid -lang %q: %v\n", *lang, err)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *boundaryCase && *capitalize {
+		fmt.Fprintf(os.Stderr, "Error: -boundary-case and -capitalize cannot be combined\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *dice < 0 || *dice > 9 {
+		fmt.Fprintf(os.Stderr, "Error: Number of dice must be between 1 and 9\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	// Flags given explicitly, as opposed to left at their defaults
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	// -paranoid only changes settings that weren't given explicitly
+	if *paranoid {
+		if !setFlags["min-bits-enforce"] {
+			*minBits = veryStrongBits
+		}
+		if !setFlags["no-file-output"] {
+			*noFileOutput = true
+		}
+		if err := lockMemory(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not lock memory: %v\n", err)
+		}
+	}
+
+	// KeePassXC's passphrase generator defaults to 7 lower-case words from
+	// the EFF large list, joined by spaces, and prints nothing else
+	switch *compat {
+	case "":
+	case "keepassxc":
+		if dictPath == "" || *format != "text" || *label || *sheet {
+			fmt.Fprintf(os.Stderr, "Error: -compat keepassxc needs a dictionary (-d) and no -format, -label or -sheet\n")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		if !setFlags["r"] {
+			*rolls = 7
+		}
+		if !setFlags["s"] {
+			*separator = " "
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Unknown -compat %q\n", *compat)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+
+	// -minimal picks the word count itself, so it needs constraints to
+	// meet and a single passphrase to pick it for
+	if *minimal && (*minBits == 0 && *policyExpr == "") {
+		fmt.Fprintf(os.Stderr, "Error: -minimal needs -min-bits-enforce or -policy-expr\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *minimal && (setFlags["r"] || *wordsFile != "" || *serve != "" || *poolFill > 0) {
+		fmt.Fprintf(os.Stderr, "Error: -minimal cannot be combined with -r, -words-file, -serve or -pool-fill\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+
+	// Show what @file arguments, presets and the default dictionary
+	// lookup amount to, for pinning an invocation
+	if *printConfig {
+		dicts := dictFiles
+		if len(dicts) == 0 && dictPath != "" {
+			dicts = []string{dictPath}
+		}
+		writeConfig(os.Stdout, dicts)
+		return
+	}
+
+	var separators []string
+	if setFlags["sep-pattern"] {
+		separators = strings.Split(*sepPattern, ",")
+	}
+	if *sepPattern == "" && separators != nil {
+		fmt.Fprintf(os.Stderr, "Error: -sep-pattern needs at least one separator\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	// A personal pattern is memorable, but anyone who knows the word
+	// knows every separator
+	if *sepFromWord != "" {
+		if separators != nil {
+			fmt.Fprintf(os.Stderr, "Error: -sep-from-word and -sep-pattern cannot be combined\n")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		for _, r := range *sepFromWord {
+			separators = append(separators, string(r))
+		}
+	}
+	if *sourceName != "crypto/rand" && *sourceName != "devrandom" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown source %q\n", *sourceName)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *deriveKey < 0 || *deriveKey > maxDerivedKey {
+		fmt.Fprintf(os.Stderr, "Error: Derived key length must be between 1 and %d bytes\n", maxDerivedKey)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *encryptIn != "" && (*encryptOut == "" || dictPath == "") {
+		fmt.Fprintf(os.Stderr, "Error: -encrypt requires -encrypt-out and a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *deriveKey > 0 && dictPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -derive-key requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *noFileOutput && (*outFile != "" || *tee || *metaFD != 0 || *poolPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -no-file-output (set by -paranoid) refuses -o, -tee, -meta-fd and -pool\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	// Metadata must not mix with the passphrase or diagnostics; 0 is off
+	if *metaFD != 0 && *metaFD < 3 {
+		fmt.Fprintf(os.Stderr, "Error: -meta-fd must be 3 or above, not stdin, stdout or stderr\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	// The key must not end up among the passphrase or the diagnostics
+	if *deriveKey > 0 && *deriveFD < 3 {
+		fmt.Fprintf(os.Stderr, "Error: -derive-key requires -derive-fd 3 or above, not stdin, stdout or stderr\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *deriveEncoding != "hex" && *deriveEncoding != "base64" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown -derive-encoding %q\n", *deriveEncoding)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	var policy policyFunc
+	if *policyExpr != "" {
+		if policy, err = parsePolicy(*policyExpr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid -policy-expr: %v\n", err)
+			printUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	if *minBits < 0 {
+		fmt.Fprintf(os.Stderr, "Error: Minimum entropy cannot be negative\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *wordsFile != "" && (*serve != "" || *preview || *dumpEntropy > 0 || *profile || *deriveKey > 0) {
+		fmt.Fprintf(os.Stderr, "Error: -words-file cannot be combined with -serve, -preview, -dump-entropy, -profile-entropy or -derive-key\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *poolSize < 0 || (*poolSize > 0 && dictPath == "") {
+		fmt.Fprintf(os.Stderr, "Error: -pool-size cannot be negative and requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if len(dictFiles) > 1 && (*minRank > 0 || *normalizeDict != "" || *poolSize > 0) {
+		fmt.Fprintf(os.Stderr, "Error: -min-rank, -normalize-dict and -pool-size take a single dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *normalizeDict != "" && dictPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -normalize-dict requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *secretIndex > 0 && !*fromSecret {
+		fmt.Fprintf(os.Stderr, "Error: -secret-index requires -from-secret\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *poolFill < 0 || *poolTake < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -pool-fill cannot be negative and -pool-take must be at least 1\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *poolPath == "" && (*poolFill > 0 || *poolTake != 1) {
+		fmt.Fprintf(os.Stderr, "Error: -pool-fill and -pool-take require -pool\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *poolPath != "" && (*wordsFile != "" || *serve != "") {
+		fmt.Fprintf(os.Stderr, "Error: -pool cannot be combined with -words-file or -serve\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *backupCodes < 0 || *backupCodeLen < 4 || *backupCodeLen > 64 {
+		fmt.Fprintf(os.Stderr, "Error: -backup-codes cannot be negative and -backup-code-length must be between 4 and 64\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *backupCodes > 0 && (*format != "text" || *label || *compat != "" || *sheet || *keyringName != "" || *serve != "" || *wordsFile != "" || *poolPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -backup-codes needs the text output, without -label, -compat, -sheet, -keyring, -serve, -words-file or -pool\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *fromSecret && *serve != "" {
+		fmt.Fprintf(os.Stderr, "Error: -from-secret cannot be combined with -serve\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *colorMode != "auto" && *colorMode != "always" && *colorMode != "never" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown -color mode %q\n", *colorMode)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *checkWeak != "off" && *checkWeak != "warn" && *checkWeak != "strict" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown -check-weak-dictionary mode %q\n", *checkWeak)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	dictEnc, err := dictionaryEncoding(*dictEncoding)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	normForm, err := normalizationForm(*normalize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	var dictPins []string
+	if *dictSHA256 != "" {
+		dictPins = strings.Split(strings.ToLower(*dictSHA256), ",")
+	}
+	for _, path := range dictFiles {
+		if strings.HasPrefix(path, "http://") {
+			fmt.Fprintf(os.Stderr, "Error: Dictionaries are only downloaded over HTTPS, not from %s\n", path)
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		if strings.HasPrefix(path, "https://") && len(dictPins) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: -d %s requires -dict-sha256\n", path)
+			printUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	if *phonetic != "" && *phonetic != "full" && *phonetic != "first" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown -phonetic mode %q\n", *phonetic)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *dumpEntropy < 0 {
+		fmt.Fprintf(os.Stderr, "Error: Number of bytes to dump cannot be negative\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *minRank < 0 {
+		fmt.Fprintf(os.Stderr, "Error: Minimum rank cannot be negative\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *weakWords != "" && dictPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -weak-words requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *minUnique < 0 || (*minUnique > 0 && dictPath == "") {
+		fmt.Fprintf(os.Stderr, "Error: -min-unique-chars cannot be negative and requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *badSubstrings != "" && dictPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -no-bad-substrings requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *minRank > 0 && dictPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -min-rank requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *maxRetries < 0 {
+		fmt.Fprintf(os.Stderr, "Error: Number of retries cannot be negative\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	alphabet := []rune(*appendAlphabet)
+	if *appendChars < 0 {
+		fmt.Fprintf(os.Stderr, "Error: Number of appended characters cannot be negative\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if *exactLength < 0 || (*exactLength > 0 && dictPath == "") {
+		fmt.Fprintf(os.Stderr, "Error: -exact-length cannot be negative and requires a dictionary (-d)\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	if (*appendChars > 0 || *exactLength > 0) && len(alphabet) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: Append alphabet must not be empty\n")
+		printUsage()
+		os.Exit(exitUsage)
+	}
+
+	// Typing in a new list needs no dictionary either; it is written the
+	// way -normalize-dict writes one
+	if *buildDict != "" {
+		if !isTerminal(os.Stdin) || !isTerminal(os.Stderr) {
+			fmt.Fprintf(os.Stderr, "Error: -build-dict requires a terminal\n")
+			os.Exit(exitUsage)
+		}
+		words, err := readWords(os.Stdin, os.Stderr, normForm)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading words: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		if len(words) < max(*minDictSize, 2) {
+			fmt.Fprintf(os.Stderr, "Error: %d words are too few for a dictionary (see -min-dict-size)\n", len(words))
+			os.Exit(exitDictionary)
+		}
+		built := &Dictionary{Words: make(map[int]string), Ranks: make(map[string]int)}
+		for i, word := range words {
+			built.Words[i] = word
+		}
+		// writeNewFile refuses an existing file, with no window between
+		// checking and writing
+		n, numDice, err := writeNormalizedDictionary(*buildDict, built, *dice)
+		if errors.Is(err, os.ErrExist) {
+			fmt.Fprintf(os.Stderr, "Error: %s already exists\n", *buildDict)
+			os.Exit(exitFailure)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing dictionary: %v\n", err)
+			os.Exit(exitDictionary)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %d words with %d dice to %s, %.2f bits per word\n", n, numDice, *buildDict, BitsPerWord(n))
+		if full := int(math.Pow(6, float64(numDice))); n < full {
+			fmt.Fprintf(os.Stderr, "Warning: a complete %d-dice list has %d words; rolls of the missing keys find none\n", numDice, full)
+		}
+		return
+	}
+
+	// Handing out from a pool needs neither a dictionary nor a source;
+	// the passphrases were generated when it was filled
+	if *poolPath != "" && *poolFill == 0 {
+		texts, left, err := takeFromPool(*poolPath, *poolTake)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		for _, text := range texts {
+			fmt.Println(text)
+		}
+		fmt.Fprintf(os.Stderr, "%d passphrases left in %s\n", left, *poolPath)
+		return
 	}
 
 	// Load dictionary if specified
-	var dict map[int]string
-	var err error
-	if *dictFile != "" {
-		dict, err = loadDictionary(*dictFile)
+	var phases phaseTimings
+	start := time.Now()
+	var dict *Dictionary
+	if dictPath != "" {
+		dict, err = openDictionary(dictPath, dictPins, *splitFirst, dictEnc)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error loading dictionary: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitDictionary)
 		}
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "Using dictionary %s\n", dictPath)
+		}
+	} else if *verbose {
+		fmt.Fprintf(os.Stderr, "No dictionary found, printing Diceware numbers only\n")
 	}
 
-	// Number of dice rolls per Diceware number (always 5)
-	numDice := 5
-
-	var passphraseWords []string
+	// Further -d lists are drawn from in turn after the first
+	dicts := []*Dictionary{dict}
+	for _, path := range dictFiles[min(1, len(dictFiles)):] {
+		extra, err := openDictionary(path, dictPins, *splitFirst, dictEnc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading dictionary: %v\n", err)
+			os.Exit(exitDictionary)
+		}
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "Using dictionary %s\n", path)
+		}
+		dicts = append(dicts, extra)
+	}
+	// Lists mix precomposed and decomposed accents; one form keeps
+	// retyped or compared passphrases byte-identical
+	for _, d := range dicts {
+		if d != nil {
+			d.Normalize(normForm)
+		}
+	}
+	phases.add("load dictionary", start)
 
-	// Generate and print Diceware numbers and words
-	for i := 0; i < *rolls; i++ {
-		dicewareNumber, err := generateDicewareNumber(numDice)
+	// A site policy may only allow vetted lists, whatever their path
+	if *allowedHashes != "" {
+		allowed, err := loadAllowedHashes(*allowedHashes)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error generating Diceware number: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "Error loading allowed dictionary hashes: %v\n", err)
+			os.Exit(exitDictionary)
 		}
-		fmt.Printf("Diceware number %d: %05d", i+1, dicewareNumber)
-		if dict != nil {
-			if word, ok := dict[dicewareNumber]; ok {
-				fmt.Printf(" - %s", word)
-				passphraseWords = append(passphraseWords, word)
-			} else {
-				fmt.Printf(" - (word not found in dictionary for number %05d)", dicewareNumber)
+		for _, d := range dicts {
+			if d != nil && !allowed[d.SHA256] {
+				fmt.Fprintf(os.Stderr, "Error: %s (SHA-256 %s) is not in %s\n", d.Path, d.SHA256, *allowedHashes)
+				os.Exit(exitDictionary)
 			}
 		}
-		fmt.Println()
 	}
 
-	// Output complete passphrase if requested
-	if *showPassphrase && len(passphraseWords) > 0 {
-		fmt.Printf("\nComplete passphrase: %s\n", strings.Join(passphraseWords, *separator))
+	// A list truncated or mangled down to a handful of words still
+	// "works", so catch it before it yields guessable passphrases
+	for _, d := range dicts {
+		if d != nil && d.Size() < *minDictSize {
+			fmt.Fprintf(os.Stderr, "Error: %s has only %d words, %.1f bits each; that is dangerously low (see -min-dict-size)\n",
+				d.Path, d.Size(), BitsPerWord(d.Size()))
+			os.Exit(exitDictionary)
+		}
 	}
-}
 
-func generateDicewareNumber(numDice int) (int, error) {
-	result := 0
-	for i := 0; i < numDice; i++ {
-		roll, err := secureRandInt(6)
+	// A smaller pool is easier to remember but weaker; it can't be drawn
+	// by dice unless n is a power of six, so words are picked by index
+	fullSize := 0
+	if *poolSize > 0 && dict != nil {
+		if *poolSize > dict.Size() || *poolSize < *minDictSize {
+			fmt.Fprintf(os.Stderr, "Error: -pool-size must be between -min-dict-size (%d) and the %d words of %s\n", *minDictSize, dict.Size(), dict.Name)
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		fullSize = dict.Size()
+		dict.Trim(*poolSize)
+	}
+
+	for _, d := range dicts {
+		if d != nil && d.InvalidKeys > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %s has %d keys with digits outside 1-6, skipped; is it numbered from 0?\n", d.Name, d.InvalidKeys)
+		}
+	}
+
+	for _, d := range dicts {
+		if d == nil || *checkWeak == "off" {
+			continue
+		}
+		nominal, effective := BitsPerWord(d.Size()), d.DistinctEntropy()
+		if nominal-effective > weakDictionaryMargin {
+			level := "Warning"
+			if *checkWeak == "strict" {
+				level = "Error"
+			}
+			fmt.Fprintf(os.Stderr, "%s: %s has %.2f bits per word over distinct words, not %.2f for its %d keys\n",
+				level, d.Name, effective, nominal, d.Size())
+			if *checkWeak == "strict" {
+				os.Exit(exitDictionary)
+			}
+		}
+	}
+
+	// Curating a list doesn't generate anything
+	if *normalizeDict != "" {
+		n, numDice, err := writeNormalizedDictionary(*normalizeDict, dict, *dice)
 		if err != nil {
-			return 0, fmt.Errorf("failed to generate random number: %v", err)
+			fmt.Fprintf(os.Stderr, "Error normalizing dictionary: %v\n", err)
+			os.Exit(exitDictionary)
 		}
-		roll++ // Add 1 to get a number between 1 and 6
-		result = result*10 + int(roll)
+		if full := int(math.Pow(6, float64(numDice))); n < full {
+			fmt.Fprintf(os.Stderr, "Warning: %d distinct words, a complete %d-dice list has %d\n", n, numDice, full)
+		}
+		return
 	}
-	return result, nil
-}
 
-func secureRandInt(max int32) (int32, error) {
-	var n int32
-	err := binary.Read(rand.Reader, binary.BigEndian, &n)
-	if err != nil {
-		return 0, err
+	var fixedWords []string
+	if *wordsFile != "" {
+		fixedWords, err = loadWordsFile(*wordsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading words file: %v\n", err)
+			os.Exit(exitFailure)
+		}
 	}
-	n = n & 0x7FFFFFFF
-	return n % max, nil
-}
 
-func loadDictionary(filename string) (map[int]string, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+	var blocked []string
+	if *badSubstrings != "" {
+		blocked, err = loadBlocklist(*badSubstrings)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading blocklist: %v\n", err)
+			os.Exit(exitFailure)
+		}
+	}
+	weak := make(map[string]bool)
+	if *weakWords != "" {
+		list, err := loadBlocklist(*weakWords)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading weak words: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		for _, word := range list {
+			weak[word] = true
+		}
 	}
-	defer file.Close()
 
-	dict := make(map[int]string)
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, "\t")
-		if len(parts) >= 2 {
-			var number int
-			if _, err := fmt.Sscanf(parts[0], "%d", &number); err == nil {
-				dict[number] = parts[1]
+	// Number of dice rolls per Diceware number: -dice if given, else the
+	// key width of the dictionary, else the standard 5
+	numDice := 5
+	if *dice > 0 {
+		numDice = *dice
+	} else if dict != nil && dict.Dice > 0 {
+		numDice = dict.Dice
+	}
+
+	// Words rejected by a filter are re-rolled, which shrinks the pool
+	// of words a passphrase is drawn from
+	accept := func(word string) bool {
+		if *minRank > 0 && dict.Ranks[word] < *minRank {
+			return false
+		}
+		if weak[strings.ToLower(word)] {
+			return false
+		}
+		return !*asciiOnly || isASCII(word)
+	}
+	pool := 0
+	if dict != nil {
+		if *minRank > 0 && len(dict.Ranks) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: -min-rank needs a dictionary with a rank column\n")
+			os.Exit(exitDictionary)
+		}
+		pool = dict.Count(accept)
+		if pool < 2 {
+			fmt.Fprintf(os.Stderr, "Error: Only %d dictionary words pass the filters, too few for a passphrase\n", pool)
+			os.Exit(exitConstraint)
+		}
+	}
+	var lists []WordList
+	if len(dicts) > 1 {
+		lists = append(lists, WordList{Dict: dict, Dice: numDice, Pool: pool})
+		for _, d := range dicts[1:] {
+			l := WordList{Dict: d, Dice: d.Dice, Pool: d.Count(accept)}
+			if *dice > 0 {
+				l.Dice = *dice
 			}
+			if l.Pool < 2 {
+				fmt.Fprintf(os.Stderr, "Error: Only %d words of %s pass the filters, too few for a passphrase\n", l.Pool, d.Name)
+				os.Exit(exitConstraint)
+			}
+			lists = append(lists, l)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
+	// Check a physical roll against each list it could be looked up in
+	if *explain != "" {
+		if dict == nil {
+			fmt.Fprintf(os.Stderr, "Error: -explain requires a dictionary (-d)\n")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		explainLists := lists
+		if len(explainLists) == 0 {
+			explainLists = []WordList{{Dict: dict, Dice: numDice, Pool: pool}}
+		}
+		for _, l := range explainLists {
+			explainNumber(os.Stdout, *explain, l, accept)
+		}
+		return
+	}
+
+	// For reviewers: the figures come from the code SecureIndex runs
+	if *explainRNG {
+		explainRejection(os.Stdout, "Die", 6, numDice)
+		if *poolSize > 0 && dict != nil {
+			explainRejection(os.Stdout, "Word index (-pool-size)", dict.Size(), 1)
+		}
+		if *appendChars > 0 || *exactLength > 0 {
+			explainRejection(os.Stdout, "Appended character", len(alphabet), 1)
+		}
+		return
+	}
+
+	if *compare {
+		bitsPerWord := Entropy(6, numDice)
+		if dict != nil {
+			bitsPerWord = BitsPerWord(pool)
+		}
+		// With several lists, the average over one round of them
+		if len(lists) > 0 {
+			bitsPerWord = 0
+			for _, l := range lists {
+				bitsPerWord += BitsPerWord(l.Pool) / float64(len(lists))
+			}
+		}
+		printComparison(os.Stdout, bitsPerWord)
+		return
+	}
+
+	// Apply word transforms, with casing rules for the list's language
+	transform := wordTransform(langTag, *capitalize, *boundaryCase)
+
+	gen := &Generator{
+		Dict:        dict,
+		Dice:        numDice,
+		Pool:        pool,
+		Lists:       lists,
+		Accept:      accept,
+		MaxRetries:  *maxRetries,
+		Transform:   transform,
+		Separator:   *separator,
+		Separators:  separators,
+		Blocked:     blocked,
+		AppendChars: *appendChars,
+		Alphabet:    alphabet,
+		CountAddons: *countAddons,
+		Indexed:     *poolSize > 0,
+		ExactLength: *exactLength,
+	}
+	if policy != nil {
+		gen.Policy = func(p *Passphrase) bool {
+			return policy(newPolicyFacts(gen, p))
+		}
+	}
+
+	// Some validators count distinct characters in the final string
+	if *minUnique > 0 {
+		policy := gen.Policy
+		gen.Policy = func(p *Passphrase) bool {
+			return uniqueChars(p.Text) >= *minUnique && (policy == nil || policy(p))
+		}
+	}
+
+	// Bound the whole generation by -timeout if given, from opening the
+	// source on
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	// crypto/rand uses getrandom(2), which never blocks once the kernel
+	// pool is initialized; hardened setups may insist on /dev/random
+	var random io.Reader = rand.Reader
+	bufSize := randBufferSize
+	source := "crypto/rand"
+	start = time.Now()
+	if *fromSecret {
+		drbg, err := secretDRBG(*secretIndex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading secret: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		random, bufSize, source = drbg, drbgRequestSize, "hmac-drbg"
+	} else if *sourceName == "devrandom" {
+		f, err := openDevRandom()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening random source: %v\n", err)
+			os.Exit(exitSource)
+		}
+		defer f.Close()
+		random, source = f, f.Name()
+	}
+	phases.add("open source", start)
+
+	var audit *auditLogger
+	if *auditLog != "" {
+		audit, err = newAuditLogger(*auditLog, *syslogFacility, *syslogTag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		defer audit.Close()
+	}
+
+	// Passphrases found in -seen-db are discarded like ones failing the
+	// policy; the file stays locked until dwp exits
+	var seen *seenDB
+	if *seenDBPath != "" && fixedWords == nil {
+		seen, err = openSeenDB(*seenDBPath, pepper())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening seen database: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		defer seen.Close()
+		policy := gen.Policy
+		gen.Policy = func(p *Passphrase) bool {
+			return !seen.Seen(p.Text) && (policy == nil || policy(p))
+		}
+	}
+
+	// -paranoid refuses to generate from a source failing the self-test,
+	// in service mode too
+	checkSource := func(src RandSource) {
+		if !*paranoid || fixedWords != nil {
+			return
+		}
+		stats, err := measureSource(ctx, src, profileSampleSize)
+		if err != nil {
+			exitGeneration(ctx, *timeout, "Error testing random source", err)
+		}
+		if err := stats.selfTest(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Random source failed its self-test: %v\n", err)
+			os.Exit(exitSource)
+		}
+	}
+
+	// The service runs until killed, so -timeout only bounds one-shot runs
+	if *serve != "" {
+		gen.Source = newBufferedSource(random, bufSize)
+		checkSource(gen.Source)
+		if err := servePassphrases(*serve, gen, *rolls, *serveRate, *minBits, source, audit, seen); err != nil {
+			fmt.Fprintf(os.Stderr, "Error serving passphrases: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		return
+	}
+
+	gen.Source = newBufferedSource(random, bufSize)
+	if *sourceName == "devrandom" {
+		gen.Source = newBufferedSource(ctxReader{ctx, random}, bufSize)
+	}
+
+	// Raw bytes for statistical test suites such as dieharder or ent
+	if *dumpEntropy > 0 {
+		if isTerminal(os.Stdout) {
+			fmt.Fprintf(os.Stderr, "Warning: writing binary data to a terminal\n")
+		}
+		if err := writeEntropy(ctx, os.Stdout, gen.Source, *dumpEntropy); err != nil {
+			exitGeneration(ctx, *timeout, "Error dumping entropy", err)
+		}
+		return
+	}
+
+	checkSource(gen.Source)
+
+	// One structured report for auditors; the sample passphrase is
+	// generated and measured but never shown
+	if *profile {
+		report, err := profileEntropy(ctx, gen, *rolls, source)
+		if err != nil {
+			exitGeneration(ctx, *timeout, "Error profiling entropy", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		if report.SelfTest != "passed" {
+			os.Exit(exitSource)
+		}
+		return
+	}
+
+	// Fill a pool for later runs to hand out; passphrases already in it
+	// are re-rolled like ones found in -seen-db
+	if *poolFill > 0 {
+		texts := make([]string, 0, *poolFill)
+		inPool := make(map[string]bool)
+		for dups := 0; len(texts) < *poolFill; {
+			p, err := gen.Generate(ctx, *rolls)
+			if err != nil {
+				exitGeneration(ctx, *timeout, "Error generating passphrase", err)
+			}
+			wipeNumbers(p.Numbers)
+			if entropy := gen.Entropy(p); entropy < *minBits {
+				fmt.Fprintf(os.Stderr, "Error: Passphrase has %.1f bits of entropy, below the -min-bits-enforce floor of %g\n", entropy, *minBits)
+				os.Exit(exitConstraint)
+			}
+			if strings.Contains(p.Text, "\n") {
+				fmt.Fprintf(os.Stderr, "Error: -pool needs passphrases on one line, choose a separator without a newline\n")
+				os.Exit(exitUsage)
+			}
+			if inPool[p.Text] {
+				if dups++; dups > gen.MaxRetries {
+					fmt.Fprintf(os.Stderr, "Error: too few distinct passphrases for a pool of %d\n", *poolFill)
+					os.Exit(exitConstraint)
+				}
+				continue
+			}
+			inPool[p.Text] = true
+			texts = append(texts, p.Text)
+			if err := seen.Add(p.Text); err != nil {
+				fmt.Fprintf(os.Stderr, "Error recording passphrase: %v\n", err)
+				os.Exit(exitFailure)
+			}
+		}
+		if err := writePool(*poolPath, texts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing pool: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %d passphrases to %s\n", len(texts), *poolPath)
+		return
+	}
+
+	// Generate the whole passphrase before printing anything, so an
+	// aborted run leaves no partial output behind. -words-file skips
+	// generation to exercise only the formatting below.
+	// The exception is a plain listing longer than streamRolls, which
+	// needs nothing but the current line: it is drawn while it is written,
+	// so memory stays bounded however large -r is.
+	streamed := *rolls > streamRolls && fixedWords == nil && *format == "text" &&
+		!*showPassphrase && !*label && !*sheet && *compat == "" && *keyringName == "" &&
+		!*preview && !*stream && *encryptIn == "" && *backupCodes == 0 && *minBits == 0 &&
+		*metaFD == 0 && *deriveKey == 0 && !*showGuesses && seen == nil && audit == nil &&
+		gen.Policy == nil && len(gen.Blocked) == 0 && gen.AppendChars == 0 && gen.ExactLength == 0
+	var p *Passphrase
+	start = time.Now()
+	if *minimal {
+		if p, err = minimalPassphrase(ctx, gen, *minBits, *maxRolls); err != nil {
+			exitGeneration(ctx, *timeout, "Error generating passphrase", err)
+		}
+		if p == nil {
+			fmt.Fprintf(os.Stderr, "Error: no passphrase of up to -max-rolls %d words meets -min-bits-enforce and -policy-expr\n", *maxRolls)
+			os.Exit(exitConstraint)
+		}
+		*rolls = len(p.Numbers)
+		plural := "s"
+		if *rolls == 1 {
+			plural = ""
+		}
+		fmt.Fprintf(os.Stderr, "Minimal: %d word%s, %.1f bits\n", *rolls, plural, gen.Entropy(p))
+	} else if fixedWords != nil {
+		p = gen.FromWords(fixedWords)
+	} else if streamed {
+		p = &Passphrase{}
+	} else if p, err = gen.Generate(ctx, *rolls); err != nil {
+		exitGeneration(ctx, *timeout, "Error generating passphrase", err)
+	}
+	phases.add("generate", start)
+	if *showTimings {
+		phases.write(os.Stderr)
+	}
+
+	// Let the user reject awkward passphrases; only the accepted one is
+	// written to the output
+	if *preview {
+		input := bufio.NewReader(os.Stdin)
+		for accepted := false; !accepted; {
+			fmt.Fprintf(os.Stderr, "Passphrase: %s\n[a]ccept / [r]egenerate / [q]uit? ", p.Text)
+			answer, err := input.ReadString('\n')
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "\nError reading answer: %v\n", err)
+				os.Exit(exitFailure)
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "a":
+				accepted = true
+			case "r":
+				wipeNumbers(p.Numbers)
+				p, err = gen.Generate(ctx, *rolls)
+				if err != nil {
+					exitGeneration(ctx, *timeout, "Error generating passphrase", err)
+				}
+			case "q":
+				fmt.Fprintf(os.Stderr, "Aborted, no passphrase written\n")
+				os.Exit(exitFailure)
+			}
+		}
+	}
+
+	if *stream {
+		p, err = streamPassphrases(ctx, gen, *rolls, p)
+		if err != nil {
+			exitGeneration(ctx, *timeout, "Error streaming passphrases", err)
+		}
+		if p == nil {
+			fmt.Fprintf(os.Stderr, "Aborted, no passphrase written\n")
+			os.Exit(exitFailure)
+		}
+	}
+
+	// Refuse a weak passphrase before anything is written
+	entropy := gen.Entropy(p)
+	if entropy < *minBits {
+		wipeNumbers(p.Numbers)
+		fmt.Fprintf(os.Stderr, "Error: Passphrase has %.1f bits of entropy, below the -min-bits-enforce floor of %g\n", entropy, *minBits)
+		os.Exit(exitConstraint)
+	}
+
+	// Encrypt before printing, so a failure leaves no passphrase that
+	// protects nothing
+	if *encryptIn != "" {
+		if err := encryptFile(*encryptIn, *encryptOut, p.Text); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encrypting %s: %v\n", *encryptIn, err)
+			os.Exit(exitFailure)
+		}
+	}
+
+	// Backup codes come from the same source as the passphrase and go to
+	// the same sinks, except under -from-secret: one-time codes must not be
+	// reproducible from the secret, so they come from crypto/rand then
+	codeSource := gen.Source
+	if *fromSecret {
+		codeSource = ReaderSource(rand.Reader)
+	}
+	codes := make([]string, *backupCodes)
+	for i := range codes {
+		if codes[i], err = randomChars(ctx, codeSource, *backupCodeLen, []rune(backupCodeAlphabet)); err != nil {
+			exitGeneration(ctx, *timeout, "Error generating backup codes", err)
+		}
+	}
+
+	// Send output to -o if given, readable by the owner only, and with
+	// -tee to stdout too. It is rendered once and copied to each sink, so
+	// they all get the same passphrase.
+	sinks := []io.Writer{os.Stdout}
+	if *outFile != "" {
+		f, err := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err == nil {
+			err = f.Chmod(0600)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening output file: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		defer f.Close()
+		sinks = []io.Writer{f}
+		if *tee {
+			sinks = append(sinks, os.Stdout)
+		}
+	}
+	out := new(bytes.Buffer)
+
+	// Record the generation before any output, so nothing is handed out
+	// unaudited or twice
+	if err := seen.Add(p.Text); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing seen database: %v\n", err)
+		os.Exit(exitFailure)
+	}
+	if err := audit.Log(newAuditRecord(gen, p, source)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing audit log: %v\n", err)
+		os.Exit(exitFailure)
+	}
+
+	if *keyringName != "" {
+		// Keep the passphrase out of the terminal: only the name is shown
+		if err := keyringStore(*keyringName, p.Text, *keyringTTL); err != nil {
+			fmt.Fprintf(os.Stderr, "Error storing passphrase in keyring: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		fmt.Fprintln(out, *keyringName)
+	} else if *label {
+		fmt.Fprintf(out, "%s: %s\n", passphraseLabel, p.Text)
+	} else if *compat == "keepassxc" {
+		fmt.Fprintln(out, p.Text)
+	} else if *sheet {
+		printSheet(out, p.Words, p.Appended, p.Text)
+	} else if *format == "csv" {
+		if err := writeCSV(out, gen, p, entropy); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing CSV output: %v\n", err)
+			os.Exit(exitFailure)
+		}
+	} else if *format == "md" {
+		if err := writeMarkdown(out, gen, p); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing Markdown output: %v\n", err)
+			os.Exit(exitFailure)
+		}
+	} else if *format == "json" {
+		doc := newJSONOutput(p, entropy, source, gen)
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(doc); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing JSON output: %v\n", err)
+			os.Exit(exitFailure)
+		}
+	} else {
+		// Padding is for display only and never part of the passphrase
+		width := 0
+		for _, d := range dicts {
+			if *align && d != nil {
+				width = max(width, d.MaxWordLen())
+			}
+		}
+
+		// Print Diceware numbers and words, each from its position's list
+		writeLine := func(out io.Writer, i, dicewareNumber int) {
+			l := gen.list(i)
+			key := fmt.Sprintf("%0*d", l.Dice, dicewareNumber)
+			if *pips {
+				key = diePips(key)
+			}
+			fmt.Fprintf(out, "Diceware number %d: %s", i+1, key)
+			if l.Dict != nil && *showIndex {
+				if index, ok := l.Dict.Index(dicewareNumber); ok {
+					fmt.Fprintf(out, " (#%d)", index)
+				}
+			}
+			if l.Dict != nil {
+				if word, ok := l.Dict.Word(dicewareNumber); ok {
+					fmt.Fprintf(out, " - %s", padRight(transform(i, word), width))
+					if *phonetic != "" {
+						fmt.Fprintf(out, " (%s)", spellPhonetic(transform(i, word), *phonetic == "first"))
+					}
+				} else {
+					fmt.Fprintf(out, " - (word not found in dictionary for number %0*d)", l.Dice, dicewareNumber)
+				}
+			}
+			fmt.Fprintln(out)
+		}
+		if streamed {
+			line := new(bytes.Buffer)
+			p.Rerolls, p.MostRerolls, entropy, err = streamListing(ctx, gen, *rolls, func(i, number int) {
+				writeLine(line, i, number)
+				for _, sink := range sinks {
+					if _, err := sink.Write(line.Bytes()); err != nil {
+						clear(line.Bytes())
+						fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+						os.Exit(exitFailure)
+					}
+				}
+				clear(line.Bytes())
+				line.Reset()
+			})
+			if err != nil {
+				exitGeneration(ctx, *timeout, "Error generating passphrase", err)
+			}
+		}
+		for i, dicewareNumber := range p.Numbers {
+			writeLine(out, i, dicewareNumber)
+		}
+		if fixedWords != nil {
+			for i, word := range p.Words {
+				fmt.Fprintf(out, "Word %d: %s\n", i+1, word)
+			}
+		}
+
+		if p.Appended != "" {
+			fmt.Fprintf(out, "Appended characters: %s", p.Appended)
+			if *phonetic != "" {
+				fmt.Fprintf(out, " (%s)", spellPhonetic(p.Appended, false))
+			}
+			fmt.Fprintln(out)
+		}
+
+		// Output complete passphrase if requested
+		if *showPassphrase && len(p.Words) > 0 {
+			fmt.Fprintf(out, "\nComplete passphrase: %s\n", p.Text)
+			if *chunk > 0 {
+				fmt.Fprintf(out, "Grouped to copy (not the passphrase): %s\n", chunkText(p.Text, *chunk, *chunkSep))
+			}
+		}
+		if len(codes) > 0 {
+			fmt.Fprintf(out, "\nBackup codes for one-time use, not part of the passphrase (%.1f bits each):\n",
+				Entropy(len(backupCodeAlphabet), *backupCodeLen))
+			for i, code := range codes {
+				fmt.Fprintf(out, "%3d. %s\n", i+1, code)
+			}
+		}
+	}
+	for _, sink := range sinks {
+		if _, err := sink.Write(out.Bytes()); err != nil {
+			clear(out.Bytes())
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			os.Exit(exitFailure)
+		}
+	}
+	clear(out.Bytes())
+
+	if *asciiOnly && dict != nil {
+		fmt.Fprintf(os.Stderr, "ASCII only: %d of %d words usable, %d re-rolled, %.2f instead of %.2f bits per word\n",
+			pool, dict.Size(), p.Rerolls, BitsPerWord(pool), BitsPerWord(dict.Size()))
+	}
+	if *exactLength > 0 {
+		words, added := gen.entropyParts(p)
+		fmt.Fprintf(os.Stderr, "Exact length: %d characters, %.1f bits from whole words and %.1f from random characters\n",
+			*exactLength, words, added)
+		if p.Cut > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d characters were cut off, and with them the entropy of the words they belonged to. -exact-length is for compatibility, not strength.\n", p.Cut)
+		}
+	}
+	if *sepFromWord != "" && len(p.Gaps) > 0 {
+		fmt.Fprintf(os.Stderr, "Separators: %d from -sep-from-word, counted as 0 bits; they add no entropy once the word is known\n", len(p.Gaps))
+	}
+	if fullSize > 0 {
+		fmt.Fprintf(os.Stderr, "Pool size: first %d of %d words, %.2f instead of %.2f bits per word\n",
+			dict.Size(), fullSize, BitsPerWord(dict.Size()), BitsPerWord(fullSize))
+	}
+	if len(weak) > 0 && dict != nil {
+		listed := dict.Count(func(word string) bool { return weak[strings.ToLower(word)] })
+		fmt.Fprintf(os.Stderr, "Weak words: %d dictionary words listed in %s, %d re-rolled, %.2f instead of %.2f bits per word\n",
+			listed, *weakWords, p.Rerolls, BitsPerWord(pool), BitsPerWord(dict.Size()))
+	}
+	if gen.Policy != nil {
+		fmt.Fprintf(os.Stderr, "Policy, seen database, unique characters and blocked substrings: %d passphrases discarded\n", p.Discarded)
+	} else if len(blocked) > 0 {
+		fmt.Fprintf(os.Stderr, "Blocked substrings: %d passphrases discarded\n", p.Discarded)
+	}
+	if (*showRerolls || *verbose) && fixedWords == nil {
+		fmt.Fprintf(os.Stderr, "Re-rolls: %d words re-rolled, at most %d for one word; %d passphrases discarded (-max-retries %d)\n",
+			p.Rerolls, p.MostRerolls, p.Discarded, *maxRetries)
+	}
+	if *showStrength {
+		fmt.Fprintf(os.Stderr, "Strength: %s (%.1f bits)\n", strengthLabel(entropy), entropy)
+	}
+	if *showGuesses {
+		space := gen.GuessSpace(p)
+		fmt.Fprintf(os.Stderr, "Entropy: %.1f bits = %.1f decimal digits = %s possible passphrases (%s)\n",
+			entropy, DecimalDigits(entropy), space, new(big.Float).SetInt(space).Text('e', 2))
+	}
+	if *charStats && p.Text != "" {
+		length, classes, pool := charComposition(p.Text)
+		fmt.Fprintf(os.Stderr, "Characters: %d long, %s, pool of %d: a character-based meter may claim %.1f bits, the true entropy is %.1f\n",
+			length, strings.Join(classes, " + "), pool, Entropy(pool, length), entropy)
+	}
+	if *colorStrength {
+		fmt.Fprintln(os.Stderr, strengthBar(entropy, useColor(*colorMode)))
+	}
+
+	// Write machine-readable metadata to its own descriptor if requested
+	if *metaFD > 0 {
+		meta := metadata{Entropy: entropy, Words: len(p.Numbers), Source: source}
+		if dict != nil {
+			meta.Words = len(p.Words)
+		}
+		if err := writeMetadata(*metaFD, meta); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing metadata to fd %d: %v\n", *metaFD, err)
+			os.Exit(exitFailure)
+		}
+	}
+
+	// The derived key goes to its own descriptor, never into the
+	// passphrase output
+	if *deriveKey > 0 {
+		salt, key, err := deriveFromPassphrase(p.Text, pepper(), *deriveKey)
+		if err != nil {
+			exitGeneration(ctx, *timeout, "Error deriving key", err)
+		}
+		if err := writeDerivedKey(*deriveFD, salt, key, *deriveEncoding); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing derived key to fd %d: %v\n", *deriveFD, err)
+			os.Exit(exitFailure)
+		}
+	}
+}
+
+// printSheet writes a recovery sheet: each word, and the appended
+// characters if any, on a numbered line, then the complete passphrase.
+func printSheet(w io.Writer, words []string, appended, passphrase string) {
+	lines := append([]string{}, words...)
+	if appended != "" {
+		lines = append(lines, appended)
+	}
+	for i, line := range lines {
+		fmt.Fprintf(w, "%d. %s\n", i+1, line)
+	}
+	fmt.Fprintf(w, "\nPassphrase: %s\n", passphrase)
+}
+
+// maxServeWords caps the words a -serve client may ask for.
+const maxServeWords = 64
+
+// servePassphrases runs an HTTP service answering
+// GET /passphrase?words=N&format=text|json until it fails. A bare port
+// binds to localhost; "unix:/path" serves on a Unix domain socket
+// instead.
+func servePassphrases(addr string, gen *Generator, defaultWords, perMinute int, minBits float64, source string, audit *auditLogger, seen *seenDB) error {
+	var listener net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		listener, err = listenUnix(path)
+		addr = path
+	} else {
+		if host, port, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort("127.0.0.1", addr)
+		} else if host == "" {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+		listener, err = net.Listen("tcp", addr)
+		addr = "http://" + addr
+	}
+	if err != nil {
+		return err
+	}
+
+	handler := passphraseHandler(gen, defaultWords, perMinute, minBits, source, audit, seen)
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	logEvent(slog.LevelInfo, "Serving passphrases on "+addr+" (GET /passphrase)", "addr", addr)
+	return server.Serve(listener)
+}
+
+// passphraseHandler answers GET /passphrase for servePassphrases. The
+// source isn't safe for concurrent use, so requests take turns, and
+// passphrases are never logged. Passphrases below minBits are refused
+// with 400 before they are recorded, as -min-bits-enforce does on the
+// command line.
+func passphraseHandler(gen *Generator, defaultWords, perMinute int, minBits float64, source string, audit *auditLogger, seen *seenDB) http.Handler {
+	limiter := &rateLimiter{limit: perMinute, window: time.Minute}
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/passphrase", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !limiter.allow() {
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		words := defaultWords
+		if v := r.URL.Query().Get("words"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxServeWords {
+				http.Error(w, fmt.Sprintf("words must be between 1 and %d", maxServeWords), http.StatusBadRequest)
+				return
+			}
+			words = n
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "text" && format != "json" {
+			http.Error(w, "format must be text or json", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		p, err := gen.Generate(r.Context(), words)
+		if err == nil && gen.Entropy(p) < minBits {
+			mu.Unlock()
+			http.Error(w, fmt.Sprintf("%d words give %.1f bits of entropy, below the floor of %g", words, gen.Entropy(p), minBits), http.StatusBadRequest)
+			return
+		}
+		if err == nil {
+			err = seen.Add(p.Text)
+		}
+		if err == nil {
+			err = audit.Log(newAuditRecord(gen, p, source))
+		}
+		mu.Unlock()
+		if err != nil {
+			logEvent(slog.LevelError, "could not generate passphrase", "error", err)
+			http.Error(w, "passphrase generation failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		if format == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(newJSONOutput(p, gen.Entropy(p), source, gen))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, p.Text)
+	})
+	return mux
+}
+
+// listenUnix listens on a Unix domain socket at path that only the current
+// user can connect to. Even on localhost, a TCP port is open to every user
+// of a shared host; socket permissions are not. The socket is created with
+// mode 0600 inside a private directory and then moved into place, so there
+// is no moment where others could connect.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".dwp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// rateLimiter allows up to limit requests per fixed window.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	count  int
+}
+
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.start) >= l.window {
+		l.start = now
+		l.count = 0
+	}
+	if l.count >= l.limit {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// errNoKeyctl is returned when keyutils isn't installed.
+var errNoKeyctl = errors.New("keyctl not found, please install keyutils")
+
+// keyctl runs keyctl(1) from keyutils with input on stdin and returns its
+// output. Secrets are passed through stdin, never on the command line.
+func keyctl(input string, args ...string) (string, error) {
+	cmd := exec.Command("keyctl", args...)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", errNoKeyctl
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "", fmt.Errorf("keyctl %s: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return string(out), err
+}
+
+// keyringStore adds secret to the user keyring under name, replacing any
+// previous entry, and lets the kernel drop it after ttl.
+func keyringStore(name, secret string, ttl time.Duration) error {
+	id, err := keyctl(secret, "padd", "user", name, "@u")
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		secs := strconv.Itoa(int(math.Ceil(ttl.Seconds())))
+		_, err = keyctl("", "timeout", strings.TrimSpace(id), secs)
+	}
+	return err
+}
+
+// keyringFind returns the id of the user keyring entry called name.
+func keyringFind(name string) (string, error) {
+	id, err := keyctl("", "search", "@u", "user", name)
+	if errors.Is(err, errNoKeyctl) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("no passphrase named %q in the user keyring", name)
+	}
+	return strings.TrimSpace(id), nil
+}
+
+// keyringRead returns the secret stored in the user keyring under name.
+func keyringRead(name string) (string, error) {
+	id, err := keyringFind(name)
+	if err != nil {
+		return "", err
+	}
+	return keyctl("", "pipe", id)
+}
+
+// keyringRemove unlinks the user keyring entry called name.
+func keyringRemove(name string) error {
+	id, err := keyringFind(name)
+	if err != nil {
+		return err
+	}
+	_, err = keyctl("", "unlink", id, "@u")
+	return err
+}
+
+// jsonOutput is the document written by -format json. outputSchema must
+// be updated along with it.
+type jsonOutput struct {
+	Passphrase string   `json:"passphrase"`
+	Words      []string `json:"words"`
+	Numbers    []int    `json:"numbers"`
+	Appended   string   `json:"appended,omitempty"`
+	Separators []string `json:"separators,omitempty"`
+	Entropy    float64  `json:"entropy_bits"`
+	Source     string   `json:"source"`
+	Dictionary string   `json:"dictionary,omitempty"`
+}
+
+// newJSONOutput builds the -format json document for p.
+func newJSONOutput(p *Passphrase, entropy float64, source string, gen *Generator) jsonOutput {
+	doc := jsonOutput{
+		Passphrase: p.Text,
+		Words:      p.Words,
+		Numbers:    p.Numbers,
+		Appended:   p.Appended,
+		Separators: p.Gaps,
+		Entropy:    entropy,
+		Source:     source,
+	}
+	var names []string
+	for _, l := range gen.lists() {
+		if l.Dict != nil {
+			names = append(names, l.Dict.Name)
+		}
+	}
+	doc.Dictionary = strings.Join(names, ",")
+	return doc
+}
+
+// outputSchema is the JSON Schema of jsonOutput, printed by -json-schema.
+const outputSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "dwp passphrase",
+  "type": "object",
+  "properties": {
+    "passphrase": {"type": "string", "description": "complete passphrase including appended characters"},
+    "words": {"type": ["array", "null"], "items": {"type": "string"}, "description": "dictionary words after transforms"},
+    "numbers": {"type": "array", "items": {"type": "integer"}, "description": "generated Diceware numbers"},
+    "appended": {"type": "string", "description": "random characters from -append-chars"},
+    "separators": {"type": "array", "items": {"type": "string"}, "description": "separator used in each gap of the passphrase"},
+    "entropy_bits": {"type": "number", "minimum": 0},
+    "source": {"type": "string", "description": "randomness source"},
+    "dictionary": {"type": "string", "description": "name of the dictionary file, or the -d lists separated by commas"}
+  },
+  "required": ["passphrase", "words", "numbers", "entropy_bits", "source"],
+  "additionalProperties": false
+}
+`
+
+// writeCSV writes p as CSV for -format csv: a header, a row with the
+// number, word and bits of each word, one for the appended characters if
+// any, and a total row with the entropy.
+func writeCSV(w io.Writer, gen *Generator, p *Passphrase, entropy float64) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"index", "number", "word", "bits"})
+	for i, number := range p.Numbers {
+		l := gen.list(i)
+		word, bits := "", entropyBits([]int{number}, l.Dice, l.Dict, l.Pool)
+		if l.Dict != nil {
+			if found, ok := l.Dict.Word(number); ok {
+				word = gen.Transform(i, found)
+			}
+		}
+		cw.Write([]string{strconv.Itoa(i + 1), fmt.Sprintf("%0*d", l.Dice, number), word, strconv.FormatFloat(bits, 'f', 2, 64)})
+	}
+	if p.Appended != "" {
+		bits := 0.0
+		if gen.CountAddons {
+			bits = Entropy(len(gen.Alphabet), utf8.RuneCountInString(p.Appended))
+		}
+		cw.Write([]string{"appended", "", p.Appended, strconv.FormatFloat(bits, 'f', 2, 64)})
+	}
+	cw.Write([]string{"total", "", "", strconv.FormatFloat(entropy, 'f', 2, 64)})
+	cw.Flush()
+	return cw.Error()
+}
+
+// wordTransform returns the Generator Transform for -capitalize and
+// -boundary-case, using the casing rules of lang. Entries starting with
+// punctuation, such as "'s" in the original Diceware list, are left as
+// they are: "'S" would only be harder to remember.
+func wordTransform(lang language.Tag, capitalize, boundaryCase bool) func(i int, word string) string {
+	title, lower, upper := cases.Title(lang), cases.Lower(lang), cases.Upper(lang)
+	return func(i int, word string) string {
+		r, _ := utf8.DecodeRuneInString(word)
+		switch {
+		case unicode.IsPunct(r):
+		case capitalize:
+			word = title.String(word)
+		case boundaryCase && i%2 == 0:
+			word = lower.String(word)
+		case boundaryCase:
+			word = upper.String(word)
+		}
+		return word
+	}
+}
+
+// chunkText splits s into groups of n characters joined by sep, for
+// copying a long passphrase by hand. The groups are display only.
+func chunkText(s string, n int, sep string) string {
+	var groups []string
+	for runes := []rune(s); len(runes) > 0; {
+		k := min(n, len(runes))
+		groups = append(groups, string(runes[:k]))
+		runes = runes[k:]
+	}
+	return strings.Join(groups, sep)
+}
+
+// passphraseLabel tags the -label line so scripts can tell dwp output
+// from other secrets. The version changes only if the line does.
+const passphraseLabel = "dwp-passphrase-v1"
+
+// writeMarkdown writes p for -format md: a table of index, number and
+// word, then the passphrase in a code block, ready to paste into a ticket.
+func writeMarkdown(w io.Writer, gen *Generator, p *Passphrase) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "| Index | Number | Word |\n|---:|---:|---|\n")
+	for i, number := range p.Numbers {
+		l := gen.list(i)
+		word := ""
+		if l.Dict != nil {
+			if found, ok := l.Dict.Word(number); ok {
+				word = gen.Transform(i, found)
+			}
+		}
+		fmt.Fprintf(bw, "| %d | %0*d | %s |\n", i+1, l.Dice, number, markdownCell(word))
+	}
+	if p.Appended != "" {
+		fmt.Fprintf(bw, "| appended | | %s |\n", markdownCell(p.Appended))
+	}
+
+	// The fence must be longer than any run of backticks in the passphrase
+	fence := "```"
+	for strings.Contains(p.Text, fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(bw, "\n%s\n%s\n%s\n", fence, p.Text, fence)
+	return bw.Flush()
+}
+
+// markdownCell escapes the characters that would end or format a table
+// cell, so words such as "a|b" survive intact.
+func markdownCell(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "|", `\|`, "`", "\\`", "*", `\*`, "_", `\_`)
+
+// auditRecord is one -audit-log line. It proves how a passphrase was
+// generated and must never contain its words or numbers.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`
+	Dice       int       `json:"dice"`
+	Words      int       `json:"word_count"`
+	DictSHA256 string    `json:"dictionary_sha256,omitempty"`
+	Entropy    float64   `json:"entropy_bits"`
+}
+
+// newAuditRecord describes the generation of p by gen from source.
+func newAuditRecord(gen *Generator, p *Passphrase, source string) auditRecord {
+	rec := auditRecord{
+		Time:    time.Now().UTC(),
+		Source:  source,
+		Dice:    gen.Dice,
+		Words:   len(p.Numbers),
+		Entropy: gen.Entropy(p),
+	}
+	var hashes []string
+	for _, l := range gen.lists() {
+		if l.Dict != nil {
+			hashes = append(hashes, l.Dict.SHA256)
+		}
+	}
+	rec.DictSHA256 = strings.Join(hashes, ",")
+	return rec
+}
+
+// appendAuditLog appends rec as a JSON line to the log at path, creating
+// it with mode 0600 if needed.
+func appendAuditLog(path string, rec auditRecord) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(rec); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// auditSyslog is the -audit-log value that sends records to syslog.
+const auditSyslog = "syslog"
+
+// syslogFacilities maps -syslog-facility names to their priorities.
+var syslogFacilities = map[string]syslog.Priority{
+	"auth": syslog.LOG_AUTH, "authpriv": syslog.LOG_AUTHPRIV,
+	"daemon": syslog.LOG_DAEMON, "user": syslog.LOG_USER,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// structuredLog receives the diagnostics of service mode and the audit
+// log as slog records if -log-format is set. Otherwise they are printed
+// as the usual plain lines.
+var structuredLog *slog.Logger
+
+// logEvent reports a diagnostic. args are slog key-value pairs, of which
+// a plain line only shows the "error" value, after the message. Never pass
+// a passphrase, its words or numbers.
+func logEvent(level slog.Level, msg string, args ...any) {
+	if structuredLog != nil {
+		structuredLog.Log(context.Background(), level, msg, args...)
+		return
+	}
+	switch {
+	case level >= slog.LevelError:
+		msg = "Error: " + msg
+	case level >= slog.LevelWarn:
+		msg = "Warning: " + msg
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i] == "error" {
+			msg += fmt.Sprintf(": %v", args[i+1])
+		}
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// auditLogger writes audit records to a file or to syslog. A nil
+// auditLogger discards them.
+type auditLogger struct {
+	path   string         // file for JSON lines, or auditSyslog
+	syslog *syslog.Writer // nil if syslog was unavailable
+}
+
+// newAuditLogger returns a logger for -audit-log path. If syslog is
+// requested but unavailable, records are dropped with a warning instead
+// of failing the generation.
+func newAuditLogger(path, facility, tag string) (*auditLogger, error) {
+	l := &auditLogger{path: path}
+	if path != auditSyslog {
+		return l, nil
+	}
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	w, err := syslog.New(priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		logEvent(slog.LevelWarn, "syslog unavailable, generations are not audited", "error", err)
+		return l, nil
+	}
+	l.syslog = w
+	return l, nil
+}
+
+// Log records rec. Syslog failures only print a warning.
+func (l *auditLogger) Log(rec auditRecord) error {
+	if l == nil {
+		return nil
+	}
+	if l.path != auditSyslog {
+		return appendAuditLog(l.path, rec)
+	}
+	if l.syslog == nil {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err == nil {
+		err = l.syslog.Info(string(line))
+	}
+	if err != nil {
+		logEvent(slog.LevelWarn, "could not write to syslog", "error", err)
+	}
+	return nil
+}
+
+// Close closes the syslog connection, if any.
+func (l *auditLogger) Close() error {
+	if l == nil || l.syslog == nil {
+		return nil
+	}
+	return l.syslog.Close()
+}
+
+// seenDB remembers issued passphrases as HMAC-SHA256 hashes under a
+// random salt, so the file reveals how many were issued but not which.
+// The file holds the hex salt on its first line and one hex hash per
+// line after it. A nil seenDB remembers nothing.
+type seenDB struct {
+	f      *os.File
+	salt   []byte
+	pepper []byte
+	hashes map[string]bool
+}
+
+// openSeenDB opens or creates the -seen-db file with mode 0600 and locks
+// it, so concurrent runs wait for each other instead of issuing the same
+// passphrase.
+func openSeenDB(path string, pepper []byte) (*seenDB, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %v", path, err)
+	}
+	db := &seenDB{f: f, pepper: pepper, hashes: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if _, err := hex.DecodeString(line); err != nil || len(line) != 2*sha256.Size {
+			f.Close()
+			return nil, fmt.Errorf("%s line %d: not a hex SHA-256 value", path, lineNo)
+		}
+		if db.salt == nil {
+			db.salt, _ = hex.DecodeString(line)
+		} else {
+			db.hashes[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// A new database starts with its salt
+	if db.salt == nil {
+		db.salt = make([]byte, sha256.Size)
+		if _, err := rand.Read(db.salt); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := fmt.Fprintf(f, "%x\n", db.salt); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// hash returns the hex HMAC of text under the salt, with the pepper
+// appended after a NUL byte like in deriveFromPassphrase.
+func (db *seenDB) hash(text string) string {
+	mac := hmac.New(sha256.New, db.salt)
+	mac.Write([]byte(text))
+	if len(db.pepper) > 0 {
+		mac.Write([]byte{0})
+		mac.Write(db.pepper)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Seen reports whether text was issued before.
+func (db *seenDB) Seen(text string) bool {
+	return db != nil && db.hashes[db.hash(text)]
+}
+
+// Add records text as issued, syncing the file before returning.
+func (db *seenDB) Add(text string) error {
+	if db == nil {
+		return nil
+	}
+	h := db.hash(text)
+	if _, err := fmt.Fprintln(db.f, h); err != nil {
+		return err
+	}
+	db.hashes[h] = true
+	return db.f.Sync()
+}
+
+// Close releases the lock.
+func (db *seenDB) Close() error {
+	if db == nil {
+		return nil
+	}
+	return db.f.Close()
+}
+
+// poolHeader is the first line of a -pool file. Its counters have a fixed
+// width, so handing out passphrases can update them in place.
+const poolHeader = "dwp-pool-v1 next %010d of %010d\n"
+
+// writePool creates path with mode 0600, holding texts one per line after
+// the header, none of them handed out yet.
+func writePool(path string, texts []string) error {
+	var buf bytes.Buffer
+	defer func() { clear(buf.Bytes()) }()
+	fmt.Fprintf(&buf, poolHeader, 0, len(texts))
+	for _, text := range texts {
+		buf.WriteString(text)
+		buf.WriteByte('\n')
+	}
+	return writeNewFile(path, buf.Bytes())
+}
+
+// takeFromPool hands out the next n passphrases of the pool at path and
+// returns them with the number left. The file is locked while it is
+// read and updated, so concurrent runs never get the same passphrase,
+// and the handed-out lines are overwritten with dashes.
+func takeFromPool(path string, n int) ([]string, int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, 0, fmt.Errorf("locking %s: %v", path, err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer clear(data)
+	var next, total int
+	header, body, _ := bytes.Cut(data, []byte("\n"))
+	if _, err := fmt.Sscanf(string(header)+"\n", poolHeader, &next, &total); err != nil {
+		return nil, 0, fmt.Errorf("%s is not a dwp pool", path)
+	}
+	lines := strings.SplitAfter(string(body), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) != total || next > total {
+		return nil, 0, fmt.Errorf("%s is damaged: it holds %d passphrases, its header says %d", path, len(lines), total)
+	}
+	if next+n > total {
+		return nil, 0, fmt.Errorf("%s has %d of %d passphrases left, %d requested", path, total-next, total, n)
+	}
+
+	// Blank the lines first, then move the counter past them; a crash in
+	// between loses passphrases rather than handing them out twice
+	offset := int64(len(header) + 1)
+	for _, line := range lines[:next] {
+		offset += int64(len(line))
+	}
+	texts := make([]string, n)
+	for i, line := range lines[next : next+n] {
+		texts[i] = strings.TrimSuffix(line, "\n")
+		if _, err := f.WriteAt([]byte(strings.Repeat("-", len(texts[i]))), offset); err != nil {
+			return nil, 0, err
+		}
+		offset += int64(len(line))
+	}
+	if err := f.Sync(); err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.WriteAt(fmt.Appendf(nil, poolHeader, next+n, total), 0); err != nil {
+		return nil, 0, err
+	}
+	return texts, total - next - n, f.Sync()
+}
+
+// metadata describes a generated passphrase without revealing it.
+type metadata struct {
+	Entropy float64 `json:"entropy_bits"`
+	Words   int     `json:"word_count"`
+	Source  string  `json:"source"`
+}
+
+// BitsPerWord returns the entropy of one word drawn uniformly from a
+// list of dictSize words, e.g. 12.925 for the 7776 words of a five-dice
+// list and 10.34 for 1296 words.
+func BitsPerWord(dictSize int) float64 {
+	if dictSize < 1 {
+		return 0
+	}
+	return math.Log2(float64(dictSize))
+}
+
+// Entropy returns the total entropy of words drawn independently and
+// uniformly from a list of dictSize words.
+func Entropy(dictSize, words int) float64 {
+	return float64(words) * BitsPerWord(dictSize)
+}
+
+// GuessSpace returns the number of sequences of words drawn from a list
+// of dictSize words, exactly, where Entropy gives its log2.
+func GuessSpace(dictSize, words int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(int64(max(dictSize, 1))), big.NewInt(int64(words)), nil)
+}
+
+// DecimalDigits converts an entropy in bits to the length of a random
+// decimal PIN of the same strength.
+func DecimalDigits(bits float64) float64 {
+	return bits / math.Log2(10)
+}
+
+// entropyBits returns the entropy of the generated output: log2 of the
+// pool of acceptable words per word found, or of all possible numbers
+// without a dictionary.
+func entropyBits(numbers []int, numDice int, dict *Dictionary, pool int) float64 {
+	if dict == nil {
+		return Entropy(6, len(numbers)*numDice) // every die is a draw from 6
+	}
+	found := 0
+	for _, n := range numbers {
+		if _, ok := dict.Word(n); ok {
+			found++
+		}
+	}
+	return Entropy(pool, found)
+}
+
+// Entropy thresholds in bits for the -strength labels. Anything below
+// fairBits is "weak"; each threshold is the lowest value of its label.
+const (
+	fairBits       = 40 // 40-60 bits: "fair"
+	strongBits     = 60 // 60-80 bits: "strong"
+	veryStrongBits = 80 // 80 bits and more: "very strong"
+)
+
+// strengthLabel maps an entropy in bits to a label for non-technical users.
+func strengthLabel(bits float64) string {
+	switch {
+	case bits >= veryStrongBits:
+		return "very strong"
+	case bits >= strongBits:
+		return "strong"
+	case bits >= fairBits:
+		return "fair"
+	default:
+		return "weak"
+	}
+}
+
+// charClasses are the character classes password meters commonly count,
+// with the number of characters each contributes to the pool. A character
+// belongs to the first class that has it.
+var charClasses = []struct {
+	name string
+	size int
+	has  func(r rune) bool
+}{
+	{"lower", 26, func(r rune) bool { return r >= 'a' && r <= 'z' }},
+	{"upper", 26, func(r rune) bool { return r >= 'A' && r <= 'Z' }},
+	{"digits", 10, func(r rune) bool { return r >= '0' && r <= '9' }},
+	{"space", 1, func(r rune) bool { return r == ' ' }},
+	{"symbols", 32, func(r rune) bool { return r > ' ' && r <= '~' }}, // the rest of printable ASCII
+}
+
+// charComposition returns the length of s in characters, the classes it
+// uses and the pool size a character-based meter would assume. Characters
+// outside those classes each add one to the pool.
+func charComposition(s string) (length int, classes []string, pool int) {
+	seen := make(map[string]bool)
+	other := make(map[rune]bool)
+	for _, r := range s {
+		length++
+		found := false
+		for _, c := range charClasses {
+			if c.has(r) {
+				seen[c.name], found = true, true
+				break
+			}
+		}
+		if !found {
+			other[r] = true
+		}
+	}
+	for _, c := range charClasses {
+		if seen[c.name] {
+			classes = append(classes, c.name)
+			pool += c.size
+		}
+	}
+	if len(other) > 0 {
+		classes = append(classes, "other")
+		pool += len(other)
+	}
+	return length, classes, pool
+}
+
+// policyFacts are the properties of a candidate passphrase that a
+// -policy-expr can test.
+type policyFacts struct {
+	bits      float64 // entropy as reported
+	length    int     // characters in the passphrase
+	wordCount int     // Diceware numbers drawn
+	hasDigit  bool
+	hasSymbol bool
+}
+
+func newPolicyFacts(g *Generator, p *Passphrase) policyFacts {
+	length, classes, _ := charComposition(p.Text)
+	return policyFacts{
+		bits:      g.Entropy(p),
+		length:    length,
+		wordCount: len(p.Numbers),
+		hasDigit:  slices.Contains(classes, "digits"),
+		hasSymbol: slices.Contains(classes, "symbols"),
+	}
+}
+
+// policyFunc reports whether a passphrase satisfies a -policy-expr.
+type policyFunc func(policyFacts) bool
+
+// parsePolicy compiles a -policy-expr. The grammar, with AND binding
+// tighter than OR and keywords in any case:
+//
+//	expr  = and { ("OR" | "||") and }
+//	and   = not { ("AND" | "&&") not }
+//	not   = ("NOT" | "!") not | "(" expr ")" | test
+//	test  = "hasDigit" | "hasSymbol" | name op number
+//	name  = "bits" | "length" | "wordCount"
+//	op    = "<" | "<=" | ">" | ">=" | "==" | "!="
+func parsePolicy(expr string) (policyFunc, error) {
+	tokens, err := policyTokens(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &policyParser{tokens: tokens}
+	f, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+// policyTokens splits a -policy-expr into names, numbers, operators and
+// parentheses.
+func policyTokens(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '(' || c == ')':
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			i += 2
+		case strings.ContainsRune("<>=!", rune(c)):
+			i++
+			if i < len(expr) && expr[i] == '=' {
+				i++
+			}
+		case c >= '0' && c <= '9' || c == '.':
+			for i < len(expr) && (expr[i] >= '0' && expr[i] <= '9' || expr[i] == '.') {
+				i++
+			}
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			for i < len(expr) && (expr[i] >= 'a' && expr[i] <= 'z' || expr[i] >= 'A' && expr[i] <= 'Z') {
+				i++
+			}
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+		tokens = append(tokens, expr[start:i])
+	}
+	return tokens, nil
+}
+
+// policyParser is a recursive descent parser over policyTokens.
+type policyParser struct {
+	tokens []string
+	pos    int
+}
+
+// accept consumes the next token if it is one of words, ignoring case.
+func (p *policyParser) accept(words ...string) bool {
+	if p.pos < len(p.tokens) {
+		for _, w := range words {
+			if strings.EqualFold(p.tokens[p.pos], w) {
+				p.pos++
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *policyParser) expr() (policyFunc, error) {
+	left, err := p.and()
+	for err == nil && p.accept("OR", "||") {
+		var right policyFunc
+		if right, err = p.and(); err == nil {
+			l := left
+			left = func(f policyFacts) bool { return l(f) || right(f) }
+		}
+	}
+	return left, err
+}
+
+func (p *policyParser) and() (policyFunc, error) {
+	left, err := p.not()
+	for err == nil && p.accept("AND", "&&") {
+		var right policyFunc
+		if right, err = p.not(); err == nil {
+			l := left
+			left = func(f policyFacts) bool { return l(f) && right(f) }
+		}
+	}
+	return left, err
+}
+
+func (p *policyParser) not() (policyFunc, error) {
+	switch {
+	case p.accept("NOT", "!"):
+		inner, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(f policyFacts) bool { return !inner(f) }, nil
+	case p.accept("("):
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, errors.New("missing )")
+		}
+		return inner, nil
+	}
+	return p.test()
+}
+
+func (p *policyParser) test() (policyFunc, error) {
+	if p.pos == len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	name := p.tokens[p.pos]
+	p.pos++
+	var value func(policyFacts) float64
+	switch strings.ToLower(name) {
+	case "hasdigit":
+		return func(f policyFacts) bool { return f.hasDigit }, nil
+	case "hassymbol":
+		return func(f policyFacts) bool { return f.hasSymbol }, nil
+	case "bits":
+		value = func(f policyFacts) float64 { return f.bits }
+	case "length":
+		value = func(f policyFacts) float64 { return float64(f.length) }
+	case "wordcount":
+		value = func(f policyFacts) float64 { return float64(f.wordCount) }
+	default:
+		return nil, fmt.Errorf("unknown predicate %q", name)
+	}
+
+	if p.pos+1 >= len(p.tokens) {
+		return nil, fmt.Errorf("%s needs a comparison, e.g. %s >= 20", name, name)
+	}
+	op, operand := p.tokens[p.pos], p.tokens[p.pos+1]
+	n, err := strconv.ParseFloat(operand, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %q is not a number", name, op, operand)
+	}
+	p.pos += 2
+	switch op {
+	case "<":
+		return func(f policyFacts) bool { return value(f) < n }, nil
+	case "<=":
+		return func(f policyFacts) bool { return value(f) <= n }, nil
+	case ">":
+		return func(f policyFacts) bool { return value(f) > n }, nil
+	case ">=":
+		return func(f policyFacts) bool { return value(f) >= n }, nil
+	case "==":
+		return func(f policyFacts) bool { return value(f) == n }, nil
+	case "!=":
+		return func(f policyFacts) bool { return value(f) != n }, nil
+	}
+	return nil, fmt.Errorf("%s: unknown comparison %q", name, op)
+}
+
+// phaseTimings records how long each phase of a run took, for -timings.
+type phaseTimings []phaseTiming
+
+type phaseTiming struct {
+	name string
+	took time.Duration
+}
+
+// add records the phase name as having run from start until now.
+func (t *phaseTimings) add(name string, start time.Time) {
+	*t = append(*t, phaseTiming{name, time.Since(start)})
+}
+
+// write prints the phases and their total as a table.
+func (t phaseTimings) write(w io.Writer) {
+	var total time.Duration
+	fmt.Fprintf(w, "%-16s %12s\n", "Phase", "Time")
+	for _, phase := range t {
+		fmt.Fprintf(w, "%-16s %12s\n", phase.name, phase.took.Round(time.Microsecond))
+		total += phase.took
+	}
+	fmt.Fprintf(w, "%-16s %12s\n", "total", total.Round(time.Microsecond))
+}
+
+// strengthBarWidth is the number of cells of the -color-strength bar,
+// which is full at strengthBarBits.
+const (
+	strengthBarWidth = 20
+	strengthBarBits  = 100
+)
+
+// strengthColors holds the ANSI color of each strength label, red to green.
+var strengthColors = map[string]string{
+	"weak":        "\x1b[31m",
+	"fair":        "\x1b[33m",
+	"strong":      "\x1b[32m",
+	"very strong": "\x1b[92m",
+}
+
+// strengthBar draws bits as a bar of strengthBarWidth cells followed by
+// the strength label, colored by label if color is set.
+func strengthBar(bits float64, color bool) string {
+	filled := int(math.Round(bits / strengthBarBits * strengthBarWidth))
+	filled = max(0, min(filled, strengthBarWidth))
+	label := strengthLabel(bits)
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", strengthBarWidth-filled)
+	if color {
+		bar = strengthColors[label] + bar + "\x1b[0m"
+	}
+	return fmt.Sprintf("[%s] %.1f bits, %s", bar, bits, label)
+}
+
+// useColor decides whether to color stderr for a -color mode. In auto
+// mode that is on a terminal, unless NO_COLOR is set.
+func useColor(mode string) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return isTerminal(os.Stderr) && os.Getenv("NO_COLOR") == ""
+}
+
+// printComparison writes a table of the entropy and strength of 4 to 10
+// word passphrases, to help choose -r.
+func printComparison(w io.Writer, bitsPerWord float64) {
+	fmt.Fprintf(w, "Words   Bits  Strength\n")
+	for words := 4; words <= 10; words++ {
+		bits := float64(words) * bitsPerWord
+		fmt.Fprintf(w, "%5d  %5.1f  %s\n", words, bits, strengthLabel(bits))
+	}
+}
+
+// explainNumber prints how the Diceware number key maps to a word of l:
+// whether dice can roll it, where it sits in the list and whether the
+// filters in accept let its word through.
+func explainNumber(w io.Writer, key string, l WordList, accept func(string) bool) {
+	fmt.Fprintf(w, "%s in %s (%d dice, %d words):\n", key, l.Dict.Name, l.Dice, l.Dict.Size())
+	if n := utf8.RuneCountInString(key); n != l.Dice {
+		fmt.Fprintf(w, "  Invalid: %d digits, the list needs %d\n", n, l.Dice)
+		return
+	}
+	if bad := strings.Trim(key, "123456"); bad != "" {
+		fmt.Fprintf(w, "  Invalid: dice show 1 to 6, not %q\n", []rune(bad)[0])
+		return
+	}
+	number, _ := strconv.Atoi(key)
+	word, ok := l.Dict.Word(number)
+	if !ok {
+		fmt.Fprintf(w, "  No word: the list has no line for this number\n")
+		return
+	}
+	index, _ := l.Dict.Index(number)
+	fmt.Fprintf(w, "  Word: %s\n  Index: %d (0-based, of %d keys in order)\n", word, index, l.Dict.Size())
+	if accept(word) {
+		fmt.Fprintf(w, "  Usable: yes, one of %d words passing the filters\n", l.Pool)
+	} else {
+		fmt.Fprintf(w, "  Usable: no, the filters re-roll it\n")
+	}
+}
+
+// writeMetadata writes meta as a single JSON line to file descriptor fd.
+func writeMetadata(fd int, meta metadata) error {
+	return json.NewEncoder(fdWriter(fd)).Encode(meta)
+}
+
+// fdWriter writes to a file descriptor the caller passed in. Unlike an
+// *os.File it never closes the descriptor, which the process doesn't own.
+type fdWriter int
+
+func (fd fdWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := syscall.Write(int(fd), p[n:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// RandSource supplies uniformly distributed random bytes.
+type RandSource interface {
+	Byte() (byte, error)
+}
+
+// openDevRandom opens /dev/random, whose reads block until the kernel
+// considers its pool ready. It is only offered on Linux, where those
+// semantics are documented.
+func openDevRandom() (*os.File, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("-source devrandom is only supported on Linux, not %s", runtime.GOOS)
+	}
+	return os.Open("/dev/random")
+}
+
+// ctxReader reads from r but gives up once ctx is done, for sources such
+// as /dev/random whose reads may block indefinitely. A blocked read can't
+// be interrupted, so each one runs in its own goroutine into a buffer of
+// its own, which is left behind if ctx ends first.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, len(p))
+	done := make(chan result, 1)
+	go func() {
+		n, err := c.r.Read(buf)
+		done <- result{n, err}
+	}()
+
+	select {
+	case r := <-done:
+		copy(p, buf[:r.n])
+		clear(buf)
+		return r.n, r.err
+	case <-c.ctx.Done():
+		return 0, c.ctx.Err()
+	}
+}
+
+// randBufferSize is how many bytes ReaderSource and the crypto/rand source
+// buffer at once; a default passphrase uses about 50.
+const randBufferSize = 512
+
+// bufferedSource serves bytes from r in chunks of len(buf) rather than
+// calling r for every byte. It returns the bytes in the order r produced
+// them, so the results match reading them one at a time.
+type bufferedSource struct {
+	r   io.Reader
+	buf []byte
+	pos int
+}
+
+func newBufferedSource(r io.Reader, size int) *bufferedSource {
+	return &bufferedSource{r: r, buf: make([]byte, size), pos: size}
+}
+
+func (s *bufferedSource) Byte() (byte, error) {
+	if s.pos == len(s.buf) {
+		if _, err := io.ReadFull(s.r, s.buf); err != nil {
+			return 0, err
+		}
+		s.pos = 0
+	}
+	b := s.buf[s.pos]
+	s.buf[s.pos] = 0 // don't keep served bytes around
+	s.pos++
+	return b, nil
+}
+
+// ReaderSource turns any reader of random bytes, such as an HSM or a
+// network RNG, into a RandSource. r must supply uniformly distributed
+// bytes; SecureIndex and the other helpers remove the bias of mapping
+// them onto a range, not bias in r itself. Reads are buffered, so r may
+// be asked for more bytes than are used.
+func ReaderSource(r io.Reader) RandSource {
+	return newBufferedSource(r, randBufferSize)
+}
+
+// maxRejections bounds the rejection loop of SecureIndex. Even in the
+// worst case a healthy source is rejected half the time, so hitting
+// this means the source is broken.
+const maxRejections = 1000
+
+// rejectionBounds returns the range SecureIndex draws from for n, a
+// power of 256, and the limit below which a value is accepted.
+func rejectionBounds(n int) (size, limit uint64) {
+	size = 256
+	for size < uint64(n) {
+		size <<= 8
+	}
+	return size, size - size%uint64(n)
+}
+
+// explainRejection writes the rejection sampling figures of SecureIndex
+// for a range of n values, of which each use draws perUse.
+func explainRejection(w io.Writer, name string, n, perUse int) {
+	size, limit := rejectionBounds(n)
+	draw := 0
+	for s := uint64(1); s < size; s <<= 8 {
+		draw++
+	}
+	accept := float64(limit) / float64(size)
+	fmt.Fprintf(w, "%s, %d values:\n", name, n)
+	fmt.Fprintf(w, "  Draw: %d byte(s), a value in 0-%d\n", draw, size-1)
+	fmt.Fprintf(w, "  Threshold: accept below %d, the largest multiple of %d not above %d, then take it mod %d\n", limit, n, size, n)
+	fmt.Fprintf(w, "  Acceptance probability: %d/%d = %.6f\n", limit, size, accept)
+	fmt.Fprintf(w, "  Expected bytes per value: %.4f\n", float64(draw)/accept)
+	if perUse > 1 {
+		fmt.Fprintf(w, "  Expected bytes per word (%d values): %.4f\n", perUse, float64(perUse*draw)/accept)
+	}
+	// The probability underflows a float64, so give its power of ten
+	if limit == size {
+		fmt.Fprintf(w, "  Rejections: none, every value is accepted\n")
+	} else {
+		fmt.Fprintf(w, "  Gives up after %d rejections in a row, probability about 10^%.0f\n", maxRejections, maxRejections*math.Log10(1-accept))
+	}
+}
+
+// SecureIndex returns a uniformly distributed integer in [0, n) read from
+// src. It draws as few bytes as cover n and rejects values from the
+// incomplete block at the top of their range, so no result is favored the
+// way a plain % n favors small ones.
+func SecureIndex(src RandSource, n int) (int, error) {
+	if n < 1 || uint64(n) > 1<<32 {
+		return 0, fmt.Errorf("index range %d out of bounds", n)
+	}
+	size, limit := rejectionBounds(n)
+
+	for attempt := 0; attempt < maxRejections; attempt++ {
+		var v uint64
+		for s := uint64(1); s < size; s <<= 8 {
+			b, err := src.Byte()
+			if err != nil {
+				return 0, err
+			}
+			v = v<<8 | uint64(b)
+		}
+		if v < limit {
+			return int(v % uint64(n)), nil
+		}
+	}
+	return 0, fmt.Errorf("random source gave %d out-of-range values in a row", maxRejections)
+}
+
+// SecureShuffle permutes n elements in place with an unbiased Fisher-Yates
+// shuffle, calling swap to exchange elements i and j.
+func SecureShuffle(src RandSource, n int, swap func(i, j int)) error {
+	for i := n - 1; i > 0; i-- {
+		j, err := SecureIndex(src, i+1)
+		if err != nil {
+			return err
+		}
+		swap(i, j)
+	}
+	return nil
+}
+
+func generateDicewareNumber(ctx context.Context, src RandSource, numDice int) (int, error) {
+	result := 0
+	for i := 0; i < numDice; i++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		roll, err := SecureIndex(src, 6)
+		if err != nil {
+			return 0, fmt.Errorf("failed to generate random number: %v", err)
+		}
+		roll++ // Add 1 to get a number between 1 and 6
+		result = result*10 + roll
+	}
+	return result, nil
+}
+
+// Generator produces passphrases from a random source and dictionary.
+// All fields but Dict must be set; without a dictionary only numbers are
+// generated.
+type Generator struct {
+	Source      RandSource
+	Dict        *Dictionary
+	Dice        int                             // dice per Diceware number
+	Pool        int                             // dictionary words passing Accept
+	Lists       []WordList                      // used in turn per word instead of Dict, if set
+	Accept      func(word string) bool          // words it rejects are re-rolled
+	MaxRetries  int                             // re-rolls allowed per word
+	Transform   func(i int, word string) string // applied to the word at position i
+	Separator   string
+	Separators  []string // used in turn between words instead of Separator
+	Blocked     []string // lower-case strings words must not form across a gap
+	AppendChars int      // random characters from Alphabet to append
+	Alphabet    []rune
+	CountAddons bool                     // count appended characters in Entropy
+	Policy      func(p *Passphrase) bool // passphrases it rejects are discarded
+	Indexed     bool                     // pick keys by index instead of rolling dice
+	ExactLength int                      // pad or cut Text to this many characters
+}
+
+// WordList is one of several dictionaries a Generator draws from in turn,
+// with its own key width and pool.
+type WordList struct {
+	Dict *Dictionary
+	Dice int // dice per Diceware number
+	Pool int // words passing the Generator's Accept
+}
+
+// list returns the word list for word position i.
+func (g *Generator) list(i int) WordList {
+	if len(g.Lists) > 0 {
+		return g.Lists[i%len(g.Lists)]
+	}
+	return WordList{Dict: g.Dict, Dice: g.Dice, Pool: g.Pool}
+}
+
+// lists returns every word list of g, in the order they are used.
+func (g *Generator) lists() []WordList {
+	if len(g.Lists) > 0 {
+		return g.Lists
+	}
+	return []WordList{g.list(0)}
+}
+
+// Passphrase is a generated passphrase and the numbers it came from.
+type Passphrase struct {
+	Numbers     []int    // Diceware numbers, one per word
+	Words       []string // transformed words found in the dictionary
+	Appended    string   // random characters appended to the words
+	Text        string   // complete passphrase
+	Gaps        []string // separator used between each part of Text
+	Rerolls     int      // numbers rejected by Accept
+	MostRerolls int      // most numbers rejected for a single word
+	Discarded   int      // passphrases discarded for a blocked substring or the policy
+	Padding     string   // random characters ExactLength added to Text
+	Cut         int      // characters ExactLength removed from the end of Text
+	Kept        int      // leading numbers whose words are still whole after a cut
+}
+
+// wholeNumbers returns the numbers whose words are entirely in Text.
+func (p *Passphrase) wholeNumbers() []int {
+	if p.Cut > 0 {
+		return p.Numbers[:p.Kept]
+	}
+	return p.Numbers
+}
+
+// Generate draws a passphrase of the given number of words. Nothing is
+// returned on failure, and the numbers drawn so far are wiped.
+func (g *Generator) Generate(ctx context.Context, words int) (*Passphrase, error) {
+	rerolls, most := 0, 0
+	for discarded := 0; ; discarded++ {
+		p, err := g.generate(ctx, words)
+		if err != nil {
+			return nil, err
+		}
+		rerolls += p.Rerolls
+		most = max(most, p.MostRerolls)
+		if !p.hasBlocked(g.Blocked) && (g.Policy == nil || g.Policy(p)) {
+			p.Rerolls, p.MostRerolls, p.Discarded = rerolls, most, discarded
+			return p, nil
+		}
+		wipeNumbers(p.Numbers)
+		if discarded == g.MaxRetries {
+			return nil, fmt.Errorf("every passphrase in %d attempts formed a blocked substring or failed the policy, %w", discarded+1, errTooRestrictive)
+		}
+	}
+}
+
+// PassphraseDetailed draws n words and returns them together with their
+// Diceware numbers for callers that build their own output. With a
+// dictionary, numbers without a word are left out so the two line up;
+// without one, words is nil. Characters from AppendChars are not returned.
+func (g *Generator) PassphraseDetailed(n int) (words []string, numbers []int, err error) {
+	p, err := g.Generate(context.Background(), n)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, number := range p.Numbers {
+		dict := g.list(i).Dict
+		if dict == nil {
+			numbers = append(numbers, number)
+		} else if _, ok := dict.Word(number); ok {
+			numbers = append(numbers, number)
+		}
+	}
+	wipeNumbers(p.Numbers)
+	return p.Words, numbers, nil
+}
+
+// generate draws one passphrase without the blocklist check.
+func (g *Generator) generate(ctx context.Context, words int) (*Passphrase, error) {
+	p := &Passphrase{Numbers: make([]int, words)}
+	for i := range p.Numbers {
+		var rerolls int
+		var err error
+		l := g.list(i)
+		p.Numbers[i], rerolls, err = drawNumber(ctx, g.Source, l.Dice, l.Dict, g.Accept, g.MaxRetries, g.Indexed)
+		p.Rerolls += rerolls
+		p.MostRerolls = max(p.MostRerolls, rerolls)
+		if err != nil {
+			wipeNumbers(p.Numbers)
+			return nil, err
+		}
+	}
+	appended, err := randomChars(ctx, g.Source, g.AppendChars, g.Alphabet)
+	if err != nil {
+		wipeNumbers(p.Numbers)
+		return nil, err
+	}
+	p.Appended = appended
+
+	for i, number := range p.Numbers {
+		if dict := g.list(i).Dict; dict != nil {
+			if word, ok := dict.Word(number); ok {
+				p.Words = append(p.Words, g.Transform(i, word))
+			}
+		}
+	}
+	g.join(p)
+	if g.ExactLength > 0 {
+		if err := g.fitLength(ctx, p); err != nil {
+			wipeNumbers(p.Numbers)
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// minimalPassphrase returns the first passphrase of the fewest words, up
+// to maxWords, that has minBits of entropy and passes the policy of g, or
+// nil if there is none. Word counts whose passphrases keep failing the
+// policy are given up after g.MaxRetries attempts, as by Generate.
+func minimalPassphrase(ctx context.Context, g *Generator, minBits float64, maxWords int) (*Passphrase, error) {
+	for words := 1; words <= maxWords; words++ {
+		p, err := g.Generate(ctx, words)
+		switch {
+		case errors.Is(err, errTooRestrictive) && ctx.Err() == nil:
+		case err != nil:
+			return nil, err
+		case g.Entropy(p) < minBits:
+			wipeNumbers(p.Numbers)
+		default:
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// streamRolls is the -r above which a plain listing is written while it
+// is drawn instead of after the whole passphrase is generated.
+const streamRolls = 1000
+
+// streamListing draws words numbers as generate does and hands each to
+// emit as soon as it is drawn, keeping none of them. It returns the
+// re-roll counts and the total entropy. Lines emitted before a failure
+// stay written.
+func streamListing(ctx context.Context, g *Generator, words int, emit func(i, number int)) (rerolls, most int, entropy float64, err error) {
+	for i := 0; i < words; i++ {
+		l := g.list(i)
+		number, n, err := drawNumber(ctx, g.Source, l.Dice, l.Dict, g.Accept, g.MaxRetries, g.Indexed)
+		rerolls += n
+		most = max(most, n)
+		if err != nil {
+			return rerolls, most, entropy, err
+		}
+		entropy += entropyBits([]int{number}, l.Dice, l.Dict, l.Pool)
+		emit(i, number)
+	}
+	return rerolls, most, entropy, nil
+}
+
+// fitLength pads the text of p with random characters from Alphabet, or
+// cuts it off, to exactly ExactLength characters. After a cut it records
+// how many leading numbers still have their whole word in the text.
+func (g *Generator) fitLength(ctx context.Context, p *Passphrase) error {
+	length := utf8.RuneCountInString(p.Text)
+	if length <= g.ExactLength {
+		pad, err := randomChars(ctx, g.Source, g.ExactLength-length, g.Alphabet)
+		if err != nil {
+			return err
+		}
+		p.Padding = pad
+		p.Text += pad
+		return nil
+	}
+	p.Cut = length - g.ExactLength
+	p.Text = string([]rune(p.Text)[:g.ExactLength])
+
+	// Walk the words along the text; each is followed by its gap
+	end, w := 0, 0
+	for i, number := range p.Numbers {
+		if dict := g.list(i).Dict; dict != nil && hasWord(dict, number) {
+			if end += utf8.RuneCountInString(p.Words[w]); end > g.ExactLength {
+				break
+			}
+			if w < len(p.Gaps) {
+				end += utf8.RuneCountInString(p.Gaps[w])
+			}
+			w++
+		}
+		p.Kept = i + 1
+	}
+	return nil
+}
+
+// FromWords builds a passphrase from the given words instead of random
+// ones, transformed and joined like a generated passphrase. It has no
+// numbers or appended characters, and no entropy.
+func (g *Generator) FromWords(words []string) *Passphrase {
+	p := &Passphrase{Numbers: []int{}}
+	for i, word := range words {
+		p.Words = append(p.Words, g.Transform(i, word))
+	}
+	g.join(p)
+	return p
+}
+
+// join sets the text of p from its words and appended characters, and
+// records the separator used in each gap.
+func (g *Generator) join(p *Passphrase) {
+	parts := p.Words
+	if p.Appended != "" {
+		parts = append(parts[:len(parts):len(parts)], p.Appended)
+	}
+	var text strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			sep := g.separator(i - 1)
+			p.Gaps = append(p.Gaps, sep)
+			text.WriteString(sep)
+		}
+		text.WriteString(part)
+	}
+	p.Text = text.String()
+}
+
+// hasBlocked reports whether one of blocked occurs in the passphrase,
+// ignoring case, across a gap rather than inside a single part.
+func (p *Passphrase) hasBlocked(blocked []string) bool {
+	if len(blocked) == 0 {
+		return false
+	}
+	text := strings.ToLower(p.Text)
+	// Byte offsets where each part ends and the next one starts
+	var ends, starts []int
+	offset := 0
+	for i, gap := range p.Gaps {
+		offset += len(p.part(i))
+		ends = append(ends, offset)
+		offset += len(gap)
+		starts = append(starts, offset)
+	}
+	for _, b := range blocked {
+		for from := 0; ; {
+			i := strings.Index(text[from:], b)
+			if i < 0 {
+				break
+			}
+			start := from + i
+			for k := range ends {
+				if start < ends[k] && start+len(b) > starts[k] {
+					return true
+				}
+			}
+			from = start + 1
+		}
+	}
+	return false
+}
+
+// part returns part i of the passphrase: a word, or the appended
+// characters after the last word.
+func (p *Passphrase) part(i int) string {
+	if i < len(p.Words) {
+		return p.Words[i]
+	}
+	return p.Appended
+}
+
+// separator returns the separator for the gap after part i.
+func (g *Generator) separator(i int) string {
+	if len(g.Separators) > 0 {
+		return g.Separators[i%len(g.Separators)]
+	}
+	return g.Separator
+}
+
+// Entropy returns the entropy of p in bits. Appended characters count only
+// with CountAddons: separators are fixed and add nothing, and an attacker
+// who knows a site's composition rules can guess the add-ons' shape, so
+// the words alone are the conservative figure.
+func (g *Generator) Entropy(p *Passphrase) float64 {
+	words, added := g.entropyParts(p)
+	if g.CountAddons {
+		return words + added
+	}
+	return words
+}
+
+// entropyParts returns the entropy of the words of p and that of its
+// random characters. Once ExactLength cut the text, only the words left
+// whole count, and no appended characters.
+func (g *Generator) entropyParts(p *Passphrase) (words, added float64) {
+	for i, number := range p.wholeNumbers() {
+		l := g.list(i)
+		words += entropyBits([]int{number}, l.Dice, l.Dict, l.Pool)
+	}
+	added = Entropy(len(g.Alphabet), utf8.RuneCountInString(p.Padding))
+	if p.Cut == 0 {
+		added += Entropy(len(g.Alphabet), utf8.RuneCountInString(p.Appended))
+	}
+	return words, added
+}
+
+// GuessSpace returns the number of passphrases p was equally likely to
+// be one of, which Entropy reports the log2 of. It is exact where the
+// float entropy rounds.
+func (g *Generator) GuessSpace(p *Passphrase) *big.Int {
+	space := big.NewInt(1)
+	for i, number := range p.wholeNumbers() {
+		l := g.list(i)
+		switch {
+		case l.Dict == nil:
+			space.Mul(space, GuessSpace(6, l.Dice))
+		case hasWord(l.Dict, number):
+			space.Mul(space, GuessSpace(l.Pool, 1))
+		}
+	}
+	if g.CountAddons {
+		space.Mul(space, GuessSpace(len(g.Alphabet), utf8.RuneCountInString(p.Padding)))
+		if p.Cut == 0 {
+			space.Mul(space, GuessSpace(len(g.Alphabet), utf8.RuneCountInString(p.Appended)))
+		}
+	}
+	return space
+}
+
+// hasWord reports whether key maps to a word of dict.
+func hasWord(dict *Dictionary, key int) bool {
+	_, ok := dict.Word(key)
+	return ok
+}
+
+// errTooRestrictive is returned when the filters reject every draw.
+var errTooRestrictive = errors.New("the filters are too restrictive")
+
+// drawNumber generates Diceware numbers until one maps to a word that
+// accept allows, giving up after maxRetries re-rolls. Numbers missing from
+// the dictionary are returned as is. It also returns the re-roll count.
+// With indexed, it picks one of the dictionary's keys uniformly instead.
+func drawNumber(ctx context.Context, src RandSource, numDice int, dict *Dictionary, accept func(string) bool, maxRetries int, indexed bool) (int, int, error) {
+	for rerolls := 0; ; rerolls++ {
+		var number int
+		var err error
+		if indexed && dict != nil {
+			number, err = dict.randomKey(ctx, src)
+		} else {
+			number, err = generateDicewareNumber(ctx, src, numDice)
+		}
+		if err != nil {
+			return 0, rerolls, err
+		}
+		if dict == nil {
+			return number, rerolls, nil
+		}
+		if word, ok := dict.Word(number); !ok || accept(word) {
+			return number, rerolls, nil
+		}
+		if rerolls == maxRetries {
+			return 0, rerolls, fmt.Errorf("no acceptable word after %d re-rolls, %w", maxRetries, errTooRestrictive)
+		}
+	}
+}
+
+// uniqueChars returns the number of distinct characters in s.
+func uniqueChars(s string) int {
+	seen := make(map[rune]bool)
+	for _, r := range s {
+		seen[r] = true
+	}
+	return len(seen)
+}
+
+// isASCII reports whether word consists of ASCII characters only.
+func isASCII(word string) bool {
+	for i := 0; i < len(word); i++ {
+		if word[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// backupCodeAlphabet holds the characters of -backup-codes: digits and
+// lower-case letters without 0, 1, i, l and o, which are easily confused
+// when codes are typed from paper.
+const backupCodeAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// defaultAppendAlphabet is the -append-alphabet default: digits and symbols
+// that are accepted by most password policies.
+const defaultAppendAlphabet = "0123456789!#$%&*+-=?@_"
+
+// randomChars returns n characters drawn uniformly from alphabet.
+func randomChars(ctx context.Context, src RandSource, n int, alphabet []rune) (string, error) {
+	chars := make([]rune, n)
+	for i := range chars {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		idx, err := SecureIndex(src, len(alphabet))
+		if err != nil {
+			return "", err
+		}
+		chars[i] = alphabet[idx]
+	}
+	return string(chars), nil
+}
+
+// drbgRequestSize is how many bytes each read from the -from-secret DRBG
+// asks for. The DRBG state advances per request, so changing it changes
+// every passphrase derived from a secret.
+const drbgRequestSize = 512
+
+// drbgPersonalization is appended to the secret when seeding, so the same
+// secret used elsewhere doesn't yield the same stream.
+const drbgPersonalization = "dwp -from-secret v1"
+
+// secretDRBG reads a secret, without echo from a terminal or as one line
+// from stdin, and returns an HMAC-DRBG seeded with it. The seed is the
+// secret followed by drbgPersonalization and, for an index above 0, the
+// index as 8 big-endian bytes, so index 0 keeps the original derivation.
+func secretDRBG(index uint64) (*hmacDRBG, error) {
+	secret, err := readSecret("Secret: ")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Warning: -from-secret is deterministic. Anyone with the secret can\n"+
+		"reproduce the passphrase, and its strength is that of the secret, not the\n"+
+		"reported entropy.\n")
+	seed := append(secret, drbgPersonalization...)
+	if index > 0 {
+		seed = binary.BigEndian.AppendUint64(seed, index)
+	}
+	drbg := newHMACDRBG(seed)
+	clear(secret)
+	return drbg, nil
+}
+
+// readSecret reads a secret typed without echo after prompt, or one line
+// from stdin if it isn't a terminal.
+func readSecret(prompt string) ([]byte, error) {
+	var secret []byte
+	var err error
+	if isTerminal(os.Stdin) {
+		fmt.Fprint(os.Stderr, prompt)
+		secret, err = term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+	} else {
+		secret, err = bufio.NewReader(os.Stdin).ReadBytes('\n')
+		if err == io.EOF {
+			err = nil
+		}
+		secret = bytes.TrimRight(secret, "\r\n")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	return secret, nil
+}
+
+// hmacDRBG is the HMAC_DRBG of NIST SP 800-90A with SHA-256 and no
+// reseeding, so its output is determined entirely by the seed.
+type hmacDRBG struct {
+	k, v []byte
+}
+
+func newHMACDRBG(seed []byte) *hmacDRBG {
+	d := &hmacDRBG{k: make([]byte, sha256.Size), v: bytes.Repeat([]byte{1}, sha256.Size)}
+	d.update(seed)
+	clear(seed)
+	return d
+}
+
+func (d *hmacDRBG) mac(data ...[]byte) []byte {
+	m := hmac.New(sha256.New, d.k)
+	for _, b := range data {
+		m.Write(b)
+	}
+	return m.Sum(nil)
+}
+
+func (d *hmacDRBG) update(data []byte) {
+	d.k = d.mac(d.v, []byte{0}, data)
+	d.v = d.mac(d.v)
+	if len(data) > 0 {
+		d.k = d.mac(d.v, []byte{1}, data)
+		d.v = d.mac(d.v)
+	}
+}
+
+// Read fills p with one generate request.
+func (d *hmacDRBG) Read(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		d.v = d.mac(d.v)
+		n += copy(p[n:], d.v)
+	}
+	d.update(nil)
+	return len(p), nil
+}
+
+// HKDF-SHA256 can produce at most 255 blocks of 32 bytes. The salt is as
+// long as one block.
+const (
+	maxDerivedKey = 255 * sha256.Size
+	saltSize      = sha256.Size
+)
+
+// pepperEnv names the environment variable holding a secret mixed into
+// -derive-key keys and -seen-db hashes, but never into the passphrase or
+// the -encrypt key. It is only read from the environment so it stays out
+// of argv.
+const pepperEnv = "DWP_PEPPER"
+
+// pepper returns the value of DWP_PEPPER, or nil if it is unset or empty.
+func pepper() []byte {
+	if v := os.Getenv(pepperEnv); v != "" {
+		return []byte(v)
+	}
+	return nil
+}
+
+// deriveFromPassphrase draws a salt from crypto/rand and derives a key of
+// n bytes from the passphrase with HKDF-SHA256 and an empty info string,
+// so it can be reproduced from the passphrase and salt alone. The salt
+// never comes from the generator's source, which is deterministic under
+// -from-secret. A pepper is appended to the passphrase after a NUL byte
+// as further input keying material.
+func deriveFromPassphrase(passphrase string, pepper []byte, n int) (salt, key []byte, err error) {
+	salt = make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	secret := []byte(passphrase)
+	if len(pepper) > 0 {
+		secret = append(append(secret, 0), pepper...)
+	}
+	defer clear(secret)
+	key, err = hkdf.Key(sha256.New, secret, salt, "", n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return salt, key, nil
+}
+
+// Files written by -encrypt start with a header, which is also the
+// AES-256-GCM additional data:
+//
+//	"dwpenc1\n"  magic
+//	3 bytes      scrypt log2(N), r and p
+//	16 bytes     scrypt salt
+//	12 bytes     GCM nonce
+//
+// followed by the ciphertext and its 16-byte tag. The key is the 32-byte
+// scrypt of the passphrase with these parameters.
+const (
+	encryptMagic   = "dwpenc1\n"
+	encryptLogN    = 15 // N = 32768, with r = 8 the RFC 7914 interactive cost
+	encryptR       = 8
+	encryptP       = 1
+	encryptSalt    = 16
+	encryptNonce   = 12
+	encryptHeader  = len(encryptMagic) + 3 + encryptSalt + encryptNonce
+	maxEncryptLogN = 20 // caps the memory a crafted header can demand
+)
+
+// encryptFile encrypts the file in with passphrase into the new file out.
+// The salt and nonce always come from crypto/rand, not the generator's
+// source: under -from-secret that is deterministic, and the same key and
+// nonce for two files would break GCM.
+func encryptFile(in, out, passphrase string) error {
+	plaintext, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	defer clear(plaintext)
+	header := append([]byte(encryptMagic), encryptLogN, encryptR, encryptP)
+	header = append(header, make([]byte, encryptSalt+encryptNonce)...)
+	if _, err := rand.Read(header[encryptHeader-encryptSalt-encryptNonce:]); err != nil {
+		return err
+	}
+	aead, err := encryptionAEAD([]byte(passphrase), header)
+	if err != nil {
+		return err
+	}
+	nonce := header[encryptHeader-encryptNonce:]
+	return writeNewFile(out, aead.Seal(header, nonce, plaintext, header))
+}
+
+// decryptFile decrypts a file written by encryptFile into the new file out.
+func decryptFile(in, out string, passphrase []byte) error {
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	if len(data) < encryptHeader || string(data[:len(encryptMagic)]) != encryptMagic {
+		return errors.New("not a file encrypted by dwp")
+	}
+	header := data[:encryptHeader]
+	aead, err := encryptionAEAD(passphrase, header)
+	if err != nil {
+		return err
+	}
+	plaintext, err := aead.Open(nil, header[encryptHeader-encryptNonce:], data[encryptHeader:], header)
+	if err != nil {
+		return errors.New("wrong passphrase or damaged file")
+	}
+	defer clear(plaintext)
+	return writeNewFile(out, plaintext)
+}
+
+// encryptionAEAD derives the key for the parameters and salt in header and
+// returns AES-256-GCM with it.
+func encryptionAEAD(passphrase, header []byte) (cipher.AEAD, error) {
+	params := header[len(encryptMagic):]
+	logN, r, p := params[0], int(params[1]), int(params[2])
+	if logN < 1 || logN > maxEncryptLogN || r < 1 || p < 1 || r*p >= 1<<30 {
+		return nil, errors.New("unsupported scrypt parameters")
+	}
+	salt := params[3 : 3+encryptSalt]
+	key, err := scrypt.Key(passphrase, salt, 1<<logN, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeNewFile writes data to a file that must not exist yet, readable by
+// the owner only.
+func writeNewFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	return f.Close()
+}
+
+// writeDerivedKey writes the salt and key to fd in the given encoding.
+func writeDerivedKey(fd int, salt, key []byte, encoding string) error {
+	encode := hex.EncodeToString
+	if encoding == "base64" {
+		encode = base64.StdEncoding.EncodeToString
+	}
+	_, err := fmt.Fprintf(fdWriter(fd), "HKDF-SHA256 salt: %s\nHKDF-SHA256 key: %s\n", encode(salt), encode(key))
+	return err
+}
+
+// lockMemory locks the process's pages into RAM so the passphrase is never
+// swapped out. Future allocations are locked too only if RLIMIT_MEMLOCK is
+// unlimited, as the Go runtime can't cope with failing to lock them.
+func lockMemory() error {
+	flags := syscall.MCL_CURRENT
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(rlimitMemlock, &limit); err == nil && limit.Cur == rlimInfinity {
+		flags |= syscall.MCL_FUTURE
+	}
+	return syscall.Mlockall(flags)
+}
+
+// rlimitMemlock is RLIMIT_MEMLOCK, which package syscall does not name, and
+// rlimInfinity is RLIM_INFINITY as the unsigned value Getrlimit reports.
+const (
+	rlimitMemlock = 8
+	rlimInfinity  = ^uint64(0)
+)
+
+// Self-test bounds for a sample of profileSampleSize bytes. A good source
+// yields a run of maxByteRun equal bytes about once in 7*10^10 samples,
+// and a chi-square over the 256 byte values above maxChiSquare, about
+// eight standard deviations over its mean of 255, about as rarely. So
+// -paranoid practically never refuses a healthy source, while a stuck or
+// badly skewed one still fails at once.
+const (
+	profileSampleSize = 4096
+	maxByteRun        = 7
+	maxChiSquare      = 430
+)
+
+// sourceStats summarizes a sample of raw bytes from the random source.
+type sourceStats struct {
+	Bytes      int     `json:"bytes"`
+	Mean       float64 `json:"mean"`
+	Shannon    float64 `json:"shannon_bits_per_byte"`
+	ChiSquare  float64 `json:"chi_square"`
+	LongestRun int     `json:"longest_run"`
+}
+
+// measureSource draws n bytes from src and computes their statistics.
+func measureSource(ctx context.Context, src RandSource, n int) (sourceStats, error) {
+	var counts [256]int
+	stats := sourceStats{Bytes: n}
+	sum, run, prev := 0, 0, -1
+	for i := 0; i < n; i++ {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		b, err := src.Byte()
+		if err != nil {
+			return stats, err
+		}
+		counts[b]++
+		sum += int(b)
+		if int(b) == prev {
+			run++
+		} else {
+			run = 1
+		}
+		prev = int(b)
+		stats.LongestRun = max(stats.LongestRun, run)
+	}
+	stats.Mean = float64(sum) / float64(n)
+	expected := float64(n) / 256
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			stats.Shannon -= p * math.Log2(p)
+		}
+		d := float64(c) - expected
+		stats.ChiSquare += d * d / expected
+	}
+	return stats, nil
+}
+
+// selfTest checks the statistics against the bounds above. It can only
+// catch a broken source, not prove a working one.
+func (s sourceStats) selfTest() error {
+	if s.LongestRun >= maxByteRun {
+		return fmt.Errorf("%d equal bytes in a row", s.LongestRun)
+	}
+	if s.ChiSquare > maxChiSquare {
+		return fmt.Errorf("chi-square %.1f above %d", s.ChiSquare, maxChiSquare)
+	}
+	return nil
+}
+
+// profileReport is the document written by -profile-entropy.
+type profileReport struct {
+	Source     string        `json:"source"`
+	SelfTest   string        `json:"self_test"`
+	Stats      sourceStats   `json:"source_stats"`
+	Dictionary *profileDict  `json:"dictionary,omitempty"`
+	Sample     profileSample `json:"sample"`
+}
+
+// profileDict identifies the dictionary in a profileReport.
+type profileDict struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Words  int    `json:"words"`
+	Pool   int    `json:"pool"`
+}
+
+// profileSample describes the sample generation of a profileReport.
+type profileSample struct {
+	Words    int     `json:"word_count"`
+	Entropy  float64 `json:"entropy_bits"`
+	Strength string  `json:"strength"`
+}
+
+// profileEntropy runs the source self-test and a sample generation of
+// the given number of words with gen.
+func profileEntropy(ctx context.Context, gen *Generator, words int, source string) (profileReport, error) {
+	report := profileReport{Source: source, SelfTest: "passed"}
+	stats, err := measureSource(ctx, gen.Source, profileSampleSize)
+	if err != nil {
+		return report, err
+	}
+	report.Stats = stats
+	if err := stats.selfTest(); err != nil {
+		report.SelfTest = "failed: " + err.Error()
+	}
+	if gen.Dict != nil {
+		report.Dictionary = &profileDict{Name: gen.Dict.Name, SHA256: gen.Dict.SHA256, Words: gen.Dict.Size(), Pool: gen.Pool}
+	}
+	p, err := gen.Generate(ctx, words)
+	if err != nil {
+		return report, err
+	}
+	defer wipeNumbers(p.Numbers)
+	entropy := gen.Entropy(p)
+	report.Sample = profileSample{Words: words, Entropy: entropy, Strength: strengthLabel(entropy)}
+	return report, nil
+}
+
+// writeEntropy copies n bytes from src to w unencoded.
+func writeEntropy(ctx context.Context, w io.Writer, src RandSource, n int) error {
+	buf := make([]byte, 0, 4096)
+	for n > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		buf = buf[:min(n, cap(buf))]
+		for i := range buf {
+			b, err := src.Byte()
+			if err != nil {
+				return err
+			}
+			buf[i] = b
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		n -= len(buf)
+	}
+	return nil
+}
+
+// exitGeneration reports a failed generation and exits with the status
+// for a -timeout expiry, unsatisfiable filters or a source failure.
+func exitGeneration(ctx context.Context, timeout time.Duration, msg string, err error) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		fmt.Fprintf(os.Stderr, "Error: timed out after %v\n", timeout)
+		os.Exit(exitTimeout)
+	case errors.Is(err, errTooRestrictive):
+		fmt.Fprintf(os.Stderr, "%s: %v\n", msg, err)
+		os.Exit(exitConstraint)
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", msg, err)
+		os.Exit(exitSource)
+	}
+}
+
+// streamPassphrases shows p on the terminal and replaces it with a fresh
+// passphrase from gen at each Enter keypress, until one is accepted with
+// a or the user quits with q. Only the current passphrase stays on
+// screen. It returns the accepted passphrase, or nil on quit. The
+// terminal is in raw mode meanwhile and restored before returning.
+func streamPassphrases(ctx context.Context, gen *Generator, words int, p *Passphrase) (*Passphrase, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	defer term.Restore(fd, state)
+	defer fmt.Fprintf(os.Stderr, "\r\x1b[K")
+
+	fmt.Fprintf(os.Stderr, "Enter: next, a: accept, q: quit\r\n")
+	key := make([]byte, 1)
+	for {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%s", p.Text)
+		if _, err := os.Stdin.Read(key); err != nil {
+			wipeNumbers(p.Numbers)
+			return nil, err
+		}
+		switch key[0] {
+		case '\r', '\n':
+			wipeNumbers(p.Numbers)
+			if p, err = gen.Generate(ctx, words); err != nil {
+				return nil, err
+			}
+		case 'a', 'A':
+			return p, nil
+		case 'q', 'Q', 3, 4: // also Ctrl-C and Ctrl-D, which raw mode delivers as bytes
+			wipeNumbers(p.Numbers)
+			return nil, nil
+		}
+	}
+}
+
+// isTerminal reports whether f is connected to a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// wipeNumbers zeroes generated Diceware numbers that will not be used.
+func wipeNumbers(numbers []int) {
+	for i := range numbers {
+		numbers[i] = 0
+	}
+}
+
+// Dictionary is a loaded Diceware list together with its metadata.
+type Dictionary struct {
+	Words       map[int]string // word for each Diceware number
+	Name        string         // base name of the list file
+	Path        string         // path the list was loaded from
+	Dice        int            // dice per number, from the key width
+	SHA256      string         // hex SHA-256 of the file contents
+	Ranks       map[string]int // frequency rank of each word, if the list has them
+	InvalidKeys int            // keys with a digit no die shows, skipped while loading
+
+	keys []int // sorted keys, built by Index on first use
+}
+
+// weakDictionaryMargin is how many bits per word the entropy of distinct
+// words may fall short of the key count before -check-weak-dictionary
+// objects.
+const weakDictionaryMargin = 0.05
+
+// DistinctEntropy returns the bits per word of a uniformly drawn key when
+// words differing only in case or punctuation count as one. It is below
+// log2 of Size if some keys share a word.
+func (d *Dictionary) DistinctEntropy() float64 {
+	counts := make(map[string]int)
+	for _, word := range d.Words {
+		counts[foldWord(word)]++
+	}
+	bits := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(len(d.Words))
+		bits -= p * math.Log2(p)
+	}
+	return bits
+}
+
+// foldWord reduces a word to its lower-case letters and digits, so near
+// duplicates such as "Apple" and "apple." compare equal.
+func foldWord(word string) string {
+	folded := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, word)
+	if folded == "" {
+		return word
+	}
+	return folded
+}
+
+// Word returns the word for Diceware number key.
+func (d *Dictionary) Word(key int) (string, bool) {
+	word, ok := d.Words[key]
+	return word, ok
+}
+
+// Index returns the 0-based position of key among the dictionary's keys
+// in ascending order, which is its line in a sorted printed list.
+func (d *Dictionary) Index(key int) (int, bool) {
+	return slices.BinarySearch(d.sortedKeys(), key)
+}
+
+// sortedKeys returns the dictionary's keys in ascending order.
+func (d *Dictionary) sortedKeys() []int {
+	if d.keys == nil {
+		d.keys = slices.Sorted(maps.Keys(d.Words))
+	}
+	return d.keys
+}
+
+// Trim keeps only the first n keys in ascending order, which for a list
+// numbered in sequence are its first n lines.
+func (d *Dictionary) Trim(n int) {
+	for _, key := range d.sortedKeys()[min(n, d.Size()):] {
+		delete(d.Words, key)
+	}
+	d.keys = nil
+}
+
+// randomKey returns one of the dictionary's keys, uniformly chosen.
+func (d *Dictionary) randomKey(ctx context.Context, src RandSource) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	i, err := SecureIndex(src, d.Size())
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random number: %v", err)
+	}
+	return d.sortedKeys()[i], nil
+}
+
+// Size returns the number of words in the dictionary.
+func (d *Dictionary) Size() int {
+	return len(d.Words)
+}
+
+// Count returns the number of words for which accept returns true.
+func (d *Dictionary) Count(accept func(string) bool) int {
+	n := 0
+	for _, word := range d.Words {
+		if accept(word) {
+			n++
+		}
+	}
+	return n
+}
+
+// MaxWordLen returns the length in characters of the longest word.
+func (d *Dictionary) MaxWordLen() int {
+	longest := 0
+	for _, word := range d.Words {
+		longest = max(longest, utf8.RuneCountInString(word))
+	}
+	return longest
+}
+
+// Normalize rewrites every word in the Unicode normalization form f.
+func (d *Dictionary) Normalize(f norm.Form) {
+	for key, word := range d.Words {
+		if f.IsNormalString(word) {
+			continue
+		}
+		d.Words[key] = f.String(word)
+		if rank, ok := d.Ranks[word]; ok {
+			delete(d.Ranks, word)
+			d.Ranks[f.String(word)] = rank
+		}
+	}
+}
+
+// padRight pads s with spaces to width characters.
+func padRight(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// natoAlphabet names letters, digits and the symbols of the default
+// -append-alphabet for reading a passphrase aloud.
+var natoAlphabet = map[rune]string{
+	'a': "Alfa", 'b': "Bravo", 'c': "Charlie", 'd': "Delta", 'e': "Echo",
+	'f': "Foxtrot", 'g': "Golf", 'h': "Hotel", 'i': "India", 'j': "Juliett",
+	'k': "Kilo", 'l': "Lima", 'm': "Mike", 'n': "November", 'o': "Oscar",
+	'p': "Papa", 'q': "Quebec", 'r': "Romeo", 's': "Sierra", 't': "Tango",
+	'u': "Uniform", 'v': "Victor", 'w': "Whiskey", 'x': "X-ray", 'y': "Yankee",
+	'z': "Zulu",
+	'0': "Zero", '1': "One", '2': "Two", '3': "Three", '4': "Four",
+	'5': "Five", '6': "Six", '7': "Seven", '8': "Eight", '9': "Nine",
+	'!': "Exclamation", '#': "Hash", '$': "Dollar", '%': "Percent",
+	'&': "Ampersand", '*': "Asterisk", '+': "Plus", '-': "Dash",
+	'=': "Equals", '?': "Question", '@': "At", '_': "Underscore", ' ': "Space",
+}
+
+// diePips replaces the digits 1 to 6 of a Diceware key with the Unicode
+// die faces U+2680 to U+2685. Terminal fonts often lack them, so -pips is
+// opt-in.
+func diePips(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '1' && r <= '6' {
+			return '⚀' + r - '1'
+		}
+		return r
+	}, key)
+}
+
+// spellPhonetic spells s in the NATO alphabet, or only its first character
+// if firstOnly is set. Capitals are marked and characters without a name
+// are quoted as they are.
+func spellPhonetic(s string, firstOnly bool) string {
+	var names []string
+	for _, r := range s {
+		lower := unicode.ToLower(r)
+		name, ok := natoAlphabet[lower]
+		switch {
+		case !ok:
+			name = strconv.QuoteRune(r)
+		case lower != r:
+			name = "Capital " + name
+		}
+		names = append(names, name)
+		if firstOnly {
+			break
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// loadBlocklist reads the strings for -no-bad-substrings, one per line.
+// Blank lines and lines starting with # are skipped.
+func loadBlocklist(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var blocked []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			blocked = append(blocked, strings.ToLower(line))
+		}
+	}
+	return blocked, nil
+}
+
+// loadAllowedHashes reads the SHA-256 values for -allowed-dict-hashes, one
+// per line. Only the first field counts, so sha256sum output works as is.
+// Blank lines and lines starting with # are skipped.
+func loadAllowedHashes(filename string) (map[string]bool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool)
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		hash := strings.ToLower(fields[0])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			return nil, fmt.Errorf("line %d: %q is not a SHA-256 value", i+1, fields[0])
+		}
+		allowed[hash] = true
+	}
+	return allowed, nil
+}
+
+// maxResponseDepth bounds how deeply @file arguments may nest.
+const maxResponseDepth = 8
+
+// writeConfig writes the command line equivalent to the settings in
+// effect: the dictionaries, then every flag whose value differs from its
+// default, including those changed by a preset.
+func writeConfig(w io.Writer, dicts []string) {
+	args := []string{filepath.Base(os.Args[0])}
+	for _, path := range dicts {
+		args = append(args, "-d", shellQuote(path))
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if f.Name == "d" || f.Name == "print-config" || value == f.DefValue {
+			return
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			if value == "true" {
+				args = append(args, "-"+f.Name)
+			} else {
+				args = append(args, "-"+f.Name+"="+value)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name, shellQuote(value))
+	})
+	fmt.Fprintln(w, strings.Join(args, " "))
+}
+
+// shellQuote quotes s for a POSIX shell unless it consists only of
+// characters no shell treats specially.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789%+,-./:=_") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// expandResponseFiles replaces each @file argument before a "--" with the
+// arguments read from file, recursively. stack holds the files being
+// expanded, to report cycles.
+func expandResponseFiles(args, stack []string) ([]string, error) {
+	var out []string
+	for i, arg := range args {
+		if arg == "--" {
+			return append(out, args[i:]...), nil
+		}
+		name, ok := strings.CutPrefix(arg, "@")
+		if !ok || name == "" {
+			out = append(out, arg)
+			continue
+		}
+		if slices.Contains(stack, name) {
+			return nil, fmt.Errorf("response file %s includes itself", name)
+		}
+		if len(stack) == maxResponseDepth {
+			return nil, fmt.Errorf("response file %s nested more than %d deep", name, maxResponseDepth)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("reading response file: %v", err)
+		}
+		fileArgs, err := splitResponseFile(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("response file %s: %v", name, err)
+		}
+		fileArgs, err = expandResponseFiles(fileArgs, append(stack, name))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, fileArgs...)
+	}
+	return out, nil
+}
+
+// splitResponseFile splits a response file into arguments at whitespace,
+// as a shell would without expansions: single or double quotes keep
+// spaces, and lines starting with # are comments.
+func splitResponseFile(data string) ([]string, error) {
+	var args []string
+	for lineNo, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		var arg strings.Builder
+		inArg := false
+		var quote rune
+		for _, r := range line {
+			switch {
+			case quote != 0 && r == quote:
+				quote = 0
+			case quote != 0:
+				arg.WriteRune(r)
+			case r == '\'' || r == '"':
+				quote, inArg = r, true
+			case unicode.IsSpace(r):
+				if inArg {
+					args = append(args, arg.String())
+					arg.Reset()
+					inArg = false
+				}
+			default:
+				arg.WriteRune(r)
+				inArg = true
+			}
+		}
+		if quote != 0 {
+			return nil, fmt.Errorf("line %d: unterminated %c quote", lineNo+1, quote)
+		}
+		if inArg {
+			args = append(args, arg.String())
+		}
+	}
+	return args, nil
+}
+
+// loadWordsFile reads the words for -words-file, one per line, skipping
+// blank lines.
+func loadWordsFile(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			words = append(words, line)
+		}
+	}
+	if len(words) == 0 {
+		return nil, errors.New("no words in file")
+	}
+	return words, nil
+}
+
+// dictSearchPaths lists where findDictionary looks for a wordlist when -d
+// is not given, so distributions can package the list separately. A
+// leading ~ stands for the home directory.
+var dictSearchPaths = []string{
+	"~/.local/share/dwp/diceware",
+	"/usr/share/dict/diceware",
+}
+
+// findDictionary returns the first regular file in dictSearchPaths, or ""
+// if there is none.
+func findDictionary() string {
+	home, _ := os.UserHomeDir()
+	for _, path := range dictSearchPaths {
+		if strings.HasPrefix(path, "~/") {
+			if home == "" {
+				continue
+			}
+			path = filepath.Join(home, path[2:])
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// readWords reads the words for -build-dict from r, one per line, until an
+// empty line or the end of input, prompting on w if r is a terminal.
+// Words are put in Unicode form f. A word the loader would split, or that
+// duplicates an earlier one apart from case and punctuation, is skipped
+// with a warning.
+func readWords(r *os.File, w io.Writer, f norm.Form) ([]string, error) {
+	interactive := isTerminal(r)
+	if interactive {
+		fmt.Fprintf(w, "Type one word per line; finish with an empty line or Ctrl-D.\n")
+	}
+	var words []string
+	folded := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for {
+		if interactive {
+			fmt.Fprintf(w, "Word %d: ", len(words)+1)
+		}
+		if !scanner.Scan() {
+			break
+		}
+		word := f.String(strings.TrimSpace(scanner.Text()))
+		if word == "" {
+			break
+		}
+		if strings.ContainsAny(word, "\t\r") {
+			fmt.Fprintf(w, "Warning: %q contains a tab, skipped\n", word)
+			continue
+		}
+		if earlier, ok := folded[foldWord(word)]; ok {
+			fmt.Fprintf(w, "Warning: %q duplicates %q, skipped\n", word, earlier)
+			continue
+		}
+		folded[foldWord(word)] = word
+		words = append(words, word)
+	}
+	return words, scanner.Err()
+}
+
+// writeNormalizedDictionary writes the distinct words of dict, sorted,
+// to filename with sequential keys of numDice dice, along with their
+// ranks if the list has any. numDice 0 picks the fewest dice with room
+// for every word. Like other generated files, filename must not exist yet
+// and is created with mode 0600. It returns the number of words and dice
+// used.
+func writeNormalizedDictionary(filename string, dict *Dictionary, numDice int) (int, int, error) {
+	seen := make(map[string]bool)
+	var words []string
+	for _, word := range dict.Words {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	slices.Sort(words)
+	if numDice == 0 {
+		numDice = 1
+		for math.Pow(6, float64(numDice)) < float64(len(words)) {
+			numDice++
+		}
+	}
+	if full := math.Pow(6, float64(numDice)); float64(len(words)) > full {
+		return 0, 0, fmt.Errorf("%d distinct words don't fit in %d dice (%.0f keys)", len(words), numDice, full)
+	}
+
+	var b strings.Builder
+	for i, word := range words {
+		fmt.Fprintf(&b, "%d\t%s", diceKey(i, numDice), word)
+		if rank, ok := dict.Ranks[word]; ok {
+			fmt.Fprintf(&b, "\t%d", rank)
+		}
+		b.WriteByte('\n')
+	}
+	if err := writeNewFile(filename, []byte(b.String())); err != nil {
+		return 0, 0, err
+	}
+	return len(words), numDice, nil
+}
+
+// diceKey returns the i-th key of a numDice list in roll order: i in base
+// 6, written with the digits 1 to 6, so 0 is 11111 for five dice.
+func diceKey(i, numDice int) int {
+	key, place := 0, 1
+	for d := 0; d < numDice; d, i, place = d+1, i/6, place*10 {
+		key += (1 + i%6) * place
+	}
+	return key
+}
+
+// NewDictionary builds a dictionary from words held in memory, keyed in
+// roll order as if loaded from a list file. There must be exactly one
+// word per key, 6^dice in all, so every roll finds a word. Its SHA-256 is
+// that of the equivalent number<TAB>word file.
+func NewDictionary(words []string, dice int) (*Dictionary, error) {
+	if dice < 1 || dice > 9 {
+		return nil, fmt.Errorf("number of dice must be between 1 and 9, not %d", dice)
+	}
+	if full := int(math.Pow(6, float64(dice))); len(words) != full {
+		return nil, fmt.Errorf("%d dice need %d words, got %d", dice, full, len(words))
+	}
+	dict := make(map[int]string, len(words))
+	hash := sha256.New()
+	for i, word := range words {
+		if word == "" || strings.ContainsAny(word, "\t\r\n") {
+			return nil, fmt.Errorf("word %d: %q is empty or spans columns", i+1, word)
+		}
+		key := diceKey(i, dice)
+		dict[key] = word
+		fmt.Fprintf(hash, "%d\t%s\n", key, word)
+	}
+	return &Dictionary{
+		Words:  dict,
+		Name:   "(in memory)",
+		Dice:   dice,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+		Ranks:  make(map[string]int),
+	}, nil
+}
+
+// normalizationForm parses a -normalize form name.
+func normalizationForm(name string) (norm.Form, error) {
+	switch strings.ToUpper(name) {
+	case "NFC":
+		return norm.NFC, nil
+	case "NFKC":
+		return norm.NFKC, nil
+	}
+	return 0, fmt.Errorf("unknown -normalize form %q, use NFC or NFKC", name)
+}
+
+// dictionaryEncoding looks up a -dict-encoding name in the IANA registry.
+// It returns nil for UTF-8, which needs no transcoding.
+func dictionaryEncoding(name string) (encoding.Encoding, error) {
+	if strings.EqualFold(name, "utf-8") || strings.EqualFold(name, "utf8") {
+		return nil, nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown dictionary encoding %q", name)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("dictionary encoding %q is not supported", name)
+	}
+	return enc, nil
+}
+
+// loadDictionary reads a tab-separated Diceware list. The number of dice
+// per key is inferred from the digit width of the keys. With splitFirst,
+// a line splits at its first space or tab only, for redistributions that
+// replaced the tab with a space. A non-nil enc transcodes the file to
+// UTF-8; the hash is always of the file as stored.
+func loadDictionary(filename string, splitFirst bool, enc encoding.Encoding) (*Dictionary, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readDictionary(file, filename, splitFirst, enc)
+}
+
+// Downloads of -d https://... lists are bounded in time and size.
+const (
+	dictFetchTimeout = 30 * time.Second
+	maxDictFetchSize = 16 << 20
+)
+
+// openDictionary loads the list at path, downloading it if path is an
+// https:// URL. A download must match one of the SHA-256 values in pins
+// before it is parsed.
+func openDictionary(path string, pins []string, splitFirst bool, enc encoding.Encoding) (*Dictionary, error) {
+	if !strings.HasPrefix(path, "https://") {
+		return loadDictionary(path, splitFirst, enc)
+	}
+	client := &http.Client{
+		Timeout: dictFetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("refusing redirect to %s", req.URL)
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDictFetchSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxDictFetchSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", path, maxDictFetchSize)
+	}
+	sum := sha256.Sum256(data)
+	if !slices.Contains(pins, hex.EncodeToString(sum[:])) {
+		return nil, fmt.Errorf("%s has SHA-256 %x, which -dict-sha256 does not list", path, sum)
+	}
+	return readDictionary(bytes.NewReader(data), path, splitFirst, enc)
+}
+
+// readDictionary parses a list read from r as loadDictionary does, with
+// path recorded as its origin.
+func readDictionary(file io.Reader, filename string, splitFirst bool, enc encoding.Encoding) (*Dictionary, error) {
+	dict := make(map[int]string)
+	ranks := make(map[string]int)
+	numDice := 0
+	invalid := 0
+	lineNo := 0
+	hash := sha256.New()
+	var r io.Reader = io.TeeReader(file, hash)
+	if enc != nil {
+		r = transform.NewReader(r, enc.NewDecoder())
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		if enc == nil && !utf8.Valid(scanner.Bytes()) {
+			return nil, fmt.Errorf("line %d: invalid UTF-8, set -dict-encoding to the list's encoding", lineNo)
+		}
+		// A decoder replaces bytes it can't map with U+FFFD, so a wrong
+		// -dict-encoding would otherwise load garbled words silently
+		if enc != nil && (!utf8.Valid(scanner.Bytes()) || bytes.ContainsRune(scanner.Bytes(), utf8.RuneError)) {
+			return nil, fmt.Errorf("line %d: bytes -dict-encoding can't decode, set it to the list's encoding", lineNo)
+		}
+		// Tolerate CRLF line endings and the PGP armor around the original
+		// list; words are kept verbatim, as some are just "!" or "a&p"
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		parts := strings.Split(line, "\t")
+		if splitFirst {
+			parts = []string{line}
+			if i := strings.IndexAny(line, " \t"); i >= 0 {
+				parts = []string{line[:i], line[i+1:]}
+			}
+		}
+		if len(parts) >= 2 && parts[1] != "" {
+			var number int
+			if _, err := fmt.Sscanf(parts[0], "%d", &number); err == nil {
+				// Every key must be as wide as the first one
+				width := len(strings.TrimSpace(parts[0]))
+				if numDice == 0 {
+					numDice = width
+				} else if width != numDice {
+					return nil, fmt.Errorf("line %d: key %q has %d digits, expected %d", lineNo, parts[0], width, numDice)
+				}
+				// A key with a digit outside 1-6 can never be rolled
+				if strings.Trim(strings.TrimSpace(parts[0]), "123456") != "" {
+					invalid++
+					continue
+				}
+				// Keep multi-token phrases intact instead of just the first,
+				// unless the only extra column is a numeric frequency rank
+				word := strings.Join(parts[1:], " ")
+				if len(parts) == 3 {
+					if rank, err := strconv.Atoi(parts[2]); err == nil {
+						word = parts[1]
+						ranks[word] = rank
+					}
+				}
+				dict[number] = word
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if enc != nil {
+			return nil, fmt.Errorf("decoding after line %d: %v", lineNo, err)
+		}
 		return nil, err
 	}
 
-	return dict, nil
+	return &Dictionary{
+		Words:       dict,
+		Name:        filepath.Base(filename),
+		Path:        filename,
+		Dice:        numDice,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		Ranks:       ranks,
+		InvalidKeys: invalid,
+	}, nil
 }
 
 func printUsage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [-r rolls] [-d dictionary] [-p] [-s separator]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [-r rolls] [-d dictionary] [-p] [-s separator] [-append-chars n] [-strength] [-meta-fd fd] [-timeout duration]\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  -r rolls       number of Diceware numbers to generate (default 10)\n")
-	fmt.Fprintf(os.Stderr, "  -d dictionary  path to Diceware dictionary file\n")
+	fmt.Fprintf(os.Stderr, "  -max-rolls n   refuse more than n rolls (default 1000)\n")
+	fmt.Fprintf(os.Stderr, "  -d dictionary  path to Diceware dictionary file; repeat to use several lists\n")
+	fmt.Fprintf(os.Stderr, "                 in turn, e.g. adjectives then nouns (default: first of\n")
+	fmt.Fprintf(os.Stderr, "                 ~/.local/share/dwp/diceware, /usr/share/dict/diceware)\n")
+	fmt.Fprintf(os.Stderr, "  -v             report which dictionary file was used\n")
+	fmt.Fprintf(os.Stderr, "  -timings       report time spent loading, opening the source and generating\n")
+	fmt.Fprintf(os.Stderr, "  -print-config  print the equivalent command line after @file and presets\n")
+	fmt.Fprintf(os.Stderr, "  -split-first   split dictionary lines at the first space or tab only\n")
+	fmt.Fprintf(os.Stderr, "  -min-dict-size n  refuse dictionaries of fewer than n words (default 16)\n")
+	fmt.Fprintf(os.Stderr, "  -pool-size n   use only the first n words, picked by index (log2(n) bits each)\n")
+	fmt.Fprintf(os.Stderr, "  -allowed-dict-hashes f  refuse to run with a dictionary whose SHA-256\n")
+	fmt.Fprintf(os.Stderr, "                 is not listed in f, e.g. sha256sum output\n")
+	fmt.Fprintf(os.Stderr, "  -check-weak-dictionary m  warn (default), fail with strict, or stay quiet\n")
+	fmt.Fprintf(os.Stderr, "                 with off if duplicate words leave far less entropy than\n")
+	fmt.Fprintf(os.Stderr, "                 the key count suggests\n")
+	fmt.Fprintf(os.Stderr, "  -words-file f  format the words in f instead of generating, for testing output\n")
+	fmt.Fprintf(os.Stderr, "  -dict-sha256 h -d may also be an https:// URL; the list is downloaded and\n")
+	fmt.Fprintf(os.Stderr, "                 used only if its SHA-256 is h (or one of h1,h2,...)\n")
+	fmt.Fprintf(os.Stderr, "  -dict-encoding e  encoding of the dictionary, e.g. iso-8859-1 (default utf-8)\n")
+	fmt.Fprintf(os.Stderr, "  -normalize f   Unicode form of dictionary words: NFC (default) or NFKC\n")
+	fmt.Fprintf(os.Stderr, "  -normalize-dict f  write -d deduplicated, sorted and renumbered to the new\n")
+	fmt.Fprintf(os.Stderr, "                 file f, and exit\n")
+	fmt.Fprintf(os.Stderr, "  -build-dict f  type in words, one per line, to write a new dictionary f\n")
+	fmt.Fprintf(os.Stderr, "  -dice n        dice per number (default: dictionary key width, else 5)\n")
 	fmt.Fprintf(os.Stderr, "  -p             output complete passphrase\n")
+	fmt.Fprintf(os.Stderr, "  -chunk n       with -p, also show it in groups of n characters, like a\n")
+	fmt.Fprintf(os.Stderr, "                 product key, split by -chunk-sep (default space)\n")
 	fmt.Fprintf(os.Stderr, "  -s separator   separator for passphrase words (default space)\n")
+	fmt.Fprintf(os.Stderr, "  -sep-pattern l comma-separated separators used in turn, e.g. \" ,-\"\n")
+	fmt.Fprintf(os.Stderr, "  -sep-from-word w  use the characters of w in turn as separators (no entropy)\n")
+	fmt.Fprintf(os.Stderr, "  -ascii-only    re-roll words with non-ASCII characters\n")
+	fmt.Fprintf(os.Stderr, "  -min-rank n    re-roll words ranked below n in a number<TAB>word<TAB>rank list\n")
+	fmt.Fprintf(os.Stderr, "  -no-bad-substrings f  re-roll passphrases whose joined words form a\n")
+	fmt.Fprintf(os.Stderr, "                 string listed in f (case-insensitive)\n")
+	fmt.Fprintf(os.Stderr, "  -weak-words f  re-roll words listed in f, a list of common passwords\n")
+	fmt.Fprintf(os.Stderr, "  -policy-expr e discard passphrases failing e, e.g. \"bits >= 64 AND hasDigit\"\n")
+	fmt.Fprintf(os.Stderr, "                 (see README for the grammar)\n")
+	fmt.Fprintf(os.Stderr, "  -min-unique-chars n  discard passphrases with fewer than n distinct characters\n")
+	fmt.Fprintf(os.Stderr, "  -show-rerolls  report re-rolled words and discarded passphrases (also -v)\n")
+	fmt.Fprintf(os.Stderr, "  -max-retries n re-rolls allowed per word before giving up (default 1000)\n")
+	fmt.Fprintf(os.Stderr, "  -capitalize    capitalize each word, using the casing rules of -lang\n")
+	fmt.Fprintf(os.Stderr, "  -boundary-case alternate lower and UPPER case word by word, so the word\n")
+	fmt.Fprintf(os.Stderr, "                 boundaries stay visible without a separator\n")
+	fmt.Fprintf(os.Stderr, "  -lang tag      language of the wordlist for casing (default en)\n")
+	fmt.Fprintf(os.Stderr, "  -show-index    list each word's 0-based position in the dictionary\n")
+	fmt.Fprintf(os.Stderr, "  -pips          list numbers as die faces, e.g. ⚀⚃⚅⚁⚂ for 14623\n")
+	fmt.Fprintf(os.Stderr, "  -phonetic mode spell listed words in the NATO alphabet, full or first\n")
+	fmt.Fprintf(os.Stderr, "  -align         pad listed words to the longest dictionary word\n")
+	fmt.Fprintf(os.Stderr, "  -format f      output format: text (default), json, csv or md\n")
+	fmt.Fprintf(os.Stderr, "  -json-schema   print the JSON Schema of -format json and exit\n")
+	fmt.Fprintf(os.Stderr, "  -stream        new passphrase per Enter, a accepts, q quits (terminal only)\n")
+	fmt.Fprintf(os.Stderr, "  -preview       accept, regenerate or quit interactively (terminal only)\n")
+	fmt.Fprintf(os.Stderr, "  -compat t      match the defaults and plain output of keepassxc\n")
+	fmt.Fprintf(os.Stderr, "  -label         print only \"dwp-passphrase-v1: <passphrase>\" on one line\n")
+	fmt.Fprintf(os.Stderr, "  -sheet         print a numbered recovery sheet (requires -d)\n")
+	fmt.Fprintf(os.Stderr, "  -backup-codes n  also print n one-time recovery codes of -backup-code-length\n")
+	fmt.Fprintf(os.Stderr, "                 characters (default 10)\n")
+	fmt.Fprintf(os.Stderr, "  -keyring name  store the passphrase in the kernel keyring, print only name\n")
+	fmt.Fprintf(os.Stderr, "  -keyring-get name, -keyring-clear name  read or remove a stored passphrase\n")
+	fmt.Fprintf(os.Stderr, "  -o file        write output to file with mode 0600\n")
+	fmt.Fprintf(os.Stderr, "  -tee           with -o, also write the output to stdout\n")
+	fmt.Fprintf(os.Stderr, "  -append-chars n  append n random characters from -append-alphabet\n")
+	fmt.Fprintf(os.Stderr, "  -exact-length n  pad with -append-alphabet characters or cut to exactly n\n")
+	fmt.Fprintf(os.Stderr, "                 characters, for legacy systems (cutting loses entropy)\n")
+	fmt.Fprintf(os.Stderr, "  -include-separators-in-entropy  count appended characters in the\n")
+	fmt.Fprintf(os.Stderr, "                 reported entropy (default: words only)\n")
+	fmt.Fprintf(os.Stderr, "  -serve addr    serve GET /passphrase?words=N&format=json over HTTP\n")
+	fmt.Fprintf(os.Stderr, "                 on a port, or on a 0600 socket with unix:/path\n")
+	fmt.Fprintf(os.Stderr, "  -log-format f  report service and audit diagnostics as slog text or json\n")
+	fmt.Fprintf(os.Stderr, "  -serve-rate n  requests per minute allowed by -serve (default 60)\n")
+	fmt.Fprintf(os.Stderr, "  -explain n     show how Diceware number n maps to a word, and exit\n")
+	fmt.Fprintf(os.Stderr, "  -explain-rng   print the rejection sampling figures of the dice, and exit\n")
+	fmt.Fprintf(os.Stderr, "  -compare       print entropy for 4 to 10 words and exit\n")
+	fmt.Fprintf(os.Stderr, "  -min-bits-enforce b  exit with status 5 if the entropy is below b bits\n")
+	fmt.Fprintf(os.Stderr, "  -minimal       instead of -r, use the fewest words that meet -min-bits-enforce\n")
+	fmt.Fprintf(os.Stderr, "                 and -policy-expr\n")
+	fmt.Fprintf(os.Stderr, "  -strength      print weak/fair/strong/very strong (<40/40/60/80 bits)\n")
+	fmt.Fprintf(os.Stderr, "  -guesses       also give the entropy in decimal digits and possible passphrases\n")
+	fmt.Fprintf(os.Stderr, "  -char-stats    print length and character classes as password meters see them\n")
+	fmt.Fprintf(os.Stderr, "  -color-strength  draw a strength bar on stderr, colored per -color\n")
+	fmt.Fprintf(os.Stderr, "  -color mode    auto (default: terminal and no NO_COLOR), always or never\n")
+	fmt.Fprintf(os.Stderr, "  -seen-db f     never issue a passphrase twice, keeping salted hashes in f\n")
+	fmt.Fprintf(os.Stderr, "  -pool f        hand out the next -pool-take (default 1) unused passphrases\n")
+	fmt.Fprintf(os.Stderr, "                 from f; -pool-fill n first creates f with n of them\n")
+	fmt.Fprintf(os.Stderr, "  -audit-log f   append generation metadata, never the passphrase, to f;\n")
+	fmt.Fprintf(os.Stderr, "                 syslog sends it to syslog with -syslog-facility (default\n")
+	fmt.Fprintf(os.Stderr, "                 auth) and -syslog-tag (default dwp)\n")
+	fmt.Fprintf(os.Stderr, "  -meta-fd fd    write JSON metadata (entropy, words, source) to fd\n")
+	fmt.Fprintf(os.Stderr, "  -paranoid      lock memory, self-test the source, require 80 bits,\n")
+	fmt.Fprintf(os.Stderr, "                 refuse file output\n")
+	fmt.Fprintf(os.Stderr, "  -no-file-output  refuse -o, -tee, -meta-fd and -pool (on with -paranoid;\n")
+	fmt.Fprintf(os.Stderr, "                 -no-file-output=false allows them)\n")
+	fmt.Fprintf(os.Stderr, "  -from-secret   derive the passphrase from a secret instead of randomness\n")
+	fmt.Fprintf(os.Stderr, "  -secret-index n  with -from-secret, derive passphrase n of a series, e.g.\n")
+	fmt.Fprintf(os.Stderr, "                 one per account\n")
+	fmt.Fprintf(os.Stderr, "  -source s      crypto/rand (default) or devrandom, blocking reads from\n")
+	fmt.Fprintf(os.Stderr, "                 /dev/random (Linux only)\n")
+	fmt.Fprintf(os.Stderr, "  -profile-entropy  print a JSON self-test, dictionary and sample report\n")
+	fmt.Fprintf(os.Stderr, "  -dump-entropy n  write n raw bytes from the source to stdout and exit\n")
+	fmt.Fprintf(os.Stderr, "  -encrypt f     encrypt f with the new passphrase into -encrypt-out\n")
+	fmt.Fprintf(os.Stderr, "  -decrypt f     decrypt f into -encrypt-out, asking for the passphrase\n")
+	fmt.Fprintf(os.Stderr, "  -derive-key n  derive an n-byte HKDF-SHA256 key from the passphrase with a\n")
+	fmt.Fprintf(os.Stderr, "                 random salt; both go to -derive-fd (required, 3 or above) in\n")
+	fmt.Fprintf(os.Stderr, "                 -derive-encoding hex (default) or base64\n")
+	fmt.Fprintf(os.Stderr, "  -timeout d     abort if generation takes longer than d (e.g. 30s)\n")
+	fmt.Fprintf(os.Stderr, "Exit status: 0 success, 1 other failure, 2 invalid arguments, 3 dictionary\n")
+	fmt.Fprintf(os.Stderr, "  error, 4 random source failure, 5 filters unsatisfiable, 6 timeout\n")
+	fmt.Fprintf(os.Stderr, "Arguments of the form @file are read from file, which may nest.\n")
 	flag.PrintDefaults()
 }
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+// constSource is a RandSource that always returns the same byte.
+type constSource struct {
+	b     byte
+	reads int
+}
+
+func (c *constSource) Byte() (byte, error) {
+	c.reads++
+	return c.b, nil
+}
+
+func TestSecureIndexGivesUp(t *testing.T) {
+	// 255 is never below the limit of 252 for six values
+	src := &constSource{b: 0xff}
+	_, err := SecureIndex(src, 6)
+	if err == nil {
+		t.Fatal("SecureIndex accepted a source that is always out of range")
+	}
+	if !strings.Contains(err.Error(), "out-of-range values in a row") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if src.reads != maxRejections {
+		t.Errorf("read %d bytes, want %d", src.reads, maxRejections)
+	}
+}
+
+func TestSecureIndexAccepts(t *testing.T) {
+	src := &constSource{b: 251}
+	i, err := SecureIndex(src, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 251%6 || src.reads != 1 {
+		t.Errorf("got %d after %d reads, want %d after 1", i, src.reads, 251%6)
+	}
+}
+
+// scriptSource is a RandSource that returns the bytes of a script in turn.
+type scriptSource struct {
+	bytes []byte
+}
+
+func (s *scriptSource) Byte() (byte, error) {
+	if len(s.bytes) == 0 {
+		return 0, io.EOF
+	}
+	b := s.bytes[0]
+	s.bytes = s.bytes[1:]
+	return b, nil
+}
+
+func TestSecureShuffleUniform(t *testing.T) {
+	// Three elements take one index of 3 and one of 2. Every pair of
+	// accepted bytes must give each of the six orders equally often.
+	counts := make(map[string]int)
+	for a := 0; a < 255; a++ {
+		for b := 0; b < 256; b++ {
+			elems := []byte("abc")
+			src := &scriptSource{bytes: []byte{byte(a), byte(b)}}
+			if err := SecureShuffle(src, len(elems), func(i, j int) { elems[i], elems[j] = elems[j], elems[i] }); err != nil {
+				t.Fatal(err)
+			}
+			if len(src.bytes) != 0 {
+				t.Fatalf("bytes %d, %d: %d left unused", a, b, len(src.bytes))
+			}
+			counts[string(elems)]++
+		}
+	}
+	if len(counts) != 6 {
+		t.Fatalf("got %d orders, want 6: %v", len(counts), counts)
+	}
+	for order, n := range counts {
+		if n != 255*256/6 {
+			t.Errorf("order %s came up %d times, want %d", order, n, 255*256/6)
+		}
+	}
+}
+
+func TestSecureShuffleError(t *testing.T) {
+	swaps := 0
+	err := SecureShuffle(&constSource{b: 0xff}, 3, func(i, j int) { swaps++ })
+	if err == nil {
+		t.Fatal("SecureShuffle accepted a source that is always out of range")
+	}
+	if swaps != 0 {
+		t.Errorf("made %d swaps before failing, want 0", swaps)
+	}
+	if err := SecureShuffle(&scriptSource{}, 1, nil); err != nil {
+		t.Errorf("shuffling one element: %v", err)
+	}
+}
+
+func TestBitsPerWord(t *testing.T) {
+	tests := []struct {
+		size int
+		bits float64
+	}{
+		{7776, 12.925},
+		{1296, 10.34},
+		{6, 2.585},
+		{1, 0},
+		{0, 0},
+	}
+	for _, tt := range tests {
+		if got := BitsPerWord(tt.size); math.Abs(got-tt.bits) > 0.001 {
+			t.Errorf("BitsPerWord(%d) = %.4f, want %.3f", tt.size, got, tt.bits)
+		}
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	tests := []struct {
+		size, words int
+		bits        float64
+	}{
+		{7776, 6, 77.549},
+		{7776, 0, 0},
+		{1296, 4, 41.359},
+	}
+	for _, tt := range tests {
+		if got := Entropy(tt.size, tt.words); math.Abs(got-tt.bits) > 0.001 {
+			t.Errorf("Entropy(%d, %d) = %.4f, want %.3f", tt.size, tt.words, got, tt.bits)
+		}
+	}
+}
+
+// checkSchema reports where v, decoded JSON, breaks schema. It knows the
+// keywords outputSchema uses: type, properties, required,
+// additionalProperties, items and minimum.
+func checkSchema(schema map[string]any, v any, path string) []string {
+	var errs []string
+	if typ, ok := schema["type"]; ok {
+		var types []any
+		if list, ok := typ.([]any); ok {
+			types = list
+		} else {
+			types = []any{typ}
+		}
+		matched := false
+		for _, want := range types {
+			matched = matched || schemaType(want.(string), v)
+		}
+		if !matched {
+			return []string{fmt.Sprintf("%s: %v is not of type %v", path, v, typ)}
+		}
+	}
+	if minimum, ok := schema["minimum"].(float64); ok {
+		if n, ok := v.(float64); ok && n < minimum {
+			errs = append(errs, fmt.Sprintf("%s: %v is below %v", path, n, minimum))
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		list, _ := v.([]any)
+		for i, item := range list {
+			errs = append(errs, checkSchema(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return errs
+	}
+	props, _ := schema["properties"].(map[string]any)
+	for _, name := range schema["required"].([]any) {
+		if _, ok := obj[name.(string)]; !ok {
+			errs = append(errs, fmt.Sprintf("%s: missing %q", path, name))
+		}
+	}
+	for name, value := range obj {
+		prop, ok := props[name].(map[string]any)
+		if !ok {
+			if schema["additionalProperties"] == false {
+				errs = append(errs, fmt.Sprintf("%s: unexpected %q", path, name))
+			}
+			continue
+		}
+		errs = append(errs, checkSchema(prop, value, path+"."+name)...)
+	}
+	return errs
+}
+
+// schemaType reports whether v, decoded JSON, is of JSON Schema type typ.
+func schemaType(typ string, v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case string:
+		return typ == "string"
+	case float64:
+		return typ == "number" || typ == "integer" && v == math.Trunc(v)
+	case []any:
+		return typ == "array"
+	case map[string]any:
+		return typ == "object"
+	}
+	return false
+}
+
+func TestJSONOutputMatchesSchema(t *testing.T) {
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(outputSchema), &schema); err != nil {
+		t.Fatalf("outputSchema is not valid JSON: %v", err)
+	}
+	dict := &Dictionary{Name: "eff_large_wordlist.txt"}
+	tests := []struct {
+		name string
+		p    *Passphrase
+		gen  *Generator
+	}{
+		{"words", &Passphrase{Text: "abacus-abdomen", Words: []string{"abacus", "abdomen"}, Numbers: []int{11111, 11112}}, &Generator{Dict: dict, Dice: 5}},
+		{"appended", &Passphrase{Text: "abacus abdomen7$", Words: []string{"abacus", "abdomen"}, Numbers: []int{11111, 11112}, Appended: "7$", Gaps: []string{" "}}, &Generator{Dict: dict, Dice: 5}},
+		{"numbers only", &Passphrase{Text: "11111 11112", Numbers: []int{11111, 11112}}, &Generator{Dice: 5}},
+	}
+	for _, tt := range tests {
+		out, err := json.Marshal(newJSONOutput(tt.p, 25.85, "crypto/rand", tt.gen))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc any
+		if err := json.Unmarshal(out, &doc); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range checkSchema(schema, doc, "$") {
+			t.Errorf("%s: %s", tt.name, e)
+		}
+	}
+}
+
+func TestCapitalizeTurkish(t *testing.T) {
+	tests := []struct {
+		lang, word, want string
+	}{
+		{"tr", "istanbul", "İstanbul"},
+		{"tr", "ılık", "Ilık"},
+		{"en", "istanbul", "Istanbul"},
+		{"de", "straße", "Straße"},
+	}
+	for _, tt := range tests {
+		transform := wordTransform(language.MustParse(tt.lang), true, false)
+		if got := transform(0, tt.word); got != tt.want {
+			t.Errorf("-lang %s -capitalize %q = %q, want %q", tt.lang, tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestBoundaryCaseTurkish(t *testing.T) {
+	transform := wordTransform(language.MustParse("tr"), false, true)
+	got := []string{transform(0, "İNCİ"), transform(1, "incir")}
+	if want := []string{"inci", "İNCİR"}; got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("-lang tr -boundary-case gave %q, want %q", got, want)
+	}
+}
+
+// parseList reads list as a dictionary file without an encoding.
+func parseList(t *testing.T, list string, splitFirst bool) *Dictionary {
+	t.Helper()
+	dict, err := readDictionary(strings.NewReader(list), "test.txt", splitFirst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dict
+}
+
+func TestSplitFirst(t *testing.T) {
+	tests := []struct {
+		name, list string
+		want       map[int]string
+	}{
+		{"tab", "11\tice cream\n12\tsoda\n", map[int]string{11: "ice cream", 12: "soda"}},
+		{"space", "11 ice cream\n12 soda\n", map[int]string{11: "ice cream", 12: "soda"}},
+		{"tab then space", "11\tice cream\n", map[int]string{11: "ice cream"}},
+		{"only the first", "11\ta\tb\n", map[int]string{11: "a\tb"}},
+	}
+	for _, tt := range tests {
+		dict := parseList(t, tt.list, true)
+		if !maps.Equal(dict.Words, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, dict.Words, tt.want)
+		}
+	}
+	// Without -split-first a space does not separate the key
+	if dict := parseList(t, "11 ice cream\n", false); len(dict.Words) != 0 {
+		t.Errorf("space-separated line parsed without -split-first: %v", dict.Words)
+	}
+}
+
+func TestFinalLineWithoutNewline(t *testing.T) {
+	for _, list := range []string{"11\tabacus\n12\tabdomen", "11\tabacus\r\n12\tabdomen\r"} {
+		dict := parseList(t, list, false)
+		if got, ok := dict.Word(12); !ok || got != "abdomen" {
+			t.Errorf("%q: key 12 is %q, want the final entry abdomen", list, got)
+		}
+	}
+}
+
+func TestDictionaryEncodingMismatch(t *testing.T) {
+	ascii, err := dictionaryEncoding("us-ascii")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// é as UTF-8 is two bytes US-ASCII has no characters for
+	if _, err := readDictionary(strings.NewReader("11\tabacus\n12\tcaf\xc3\xa9\n"), "test.txt", false, ascii); err == nil {
+		t.Error("undecodable bytes loaded as replacement characters")
+	}
+	latin1, err := dictionaryEncoding("iso-8859-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, err := readDictionary(strings.NewReader("11\tcaf\xe9\n"), "test.txt", false, latin1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := dict.Word(11); got != "café" {
+		t.Errorf("decoded %q, want café", got)
+	}
+}
+
+func TestPhraseEntries(t *testing.T) {
+	dict := parseList(t, "12345\tice cream\n12346\tswim\tsuit\n12351\tsoda\t7\n", false)
+	want := map[int]string{12345: "ice cream", 12346: "swim suit", 12351: "soda"}
+	if !maps.Equal(dict.Words, want) {
+		t.Errorf("got %v, want %v", dict.Words, want)
+	}
+	// A numeric third column is a rank, not part of the phrase
+	if dict.Ranks["soda"] != 7 {
+		t.Errorf("rank of soda is %d, want 7", dict.Ranks["soda"])
+	}
+}
+
+func TestNewDictionary(t *testing.T) {
+	words := make([]string, 36)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", i)
+	}
+	dict, err := NewDictionary(words, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[int]string{11: "w0", 12: "w1", 16: "w5", 21: "w6", 66: "w35"}
+	for key, want := range keys {
+		if got, ok := dict.Word(key); !ok || got != want {
+			t.Errorf("key %d is %q, want %q", key, got, want)
+		}
+	}
+	if dict.Size() != 36 || dict.Dice != 2 {
+		t.Errorf("got %d words of %d dice, want 36 of 2", dict.Size(), dict.Dice)
+	}
+	// Its hash is that of the same list written to a file
+	var file strings.Builder
+	for i, word := range words {
+		fmt.Fprintf(&file, "%d\t%s\n", diceKey(i, 2), word)
+	}
+	if loaded := parseList(t, file.String(), false); loaded.SHA256 != dict.SHA256 {
+		t.Errorf("SHA-256 %s, want %s as loaded from a file", dict.SHA256, loaded.SHA256)
+	}
+}
+
+func TestNewDictionaryErrors(t *testing.T) {
+	six := []string{"a", "b", "c", "d", "e", "f"}
+	tests := []struct {
+		name  string
+		words []string
+		dice  int
+	}{
+		{"too few", six[:5], 1},
+		{"too many", append(six, "g"), 1},
+		{"wrong dice", six, 2},
+		{"no dice", nil, 0},
+		{"ten dice", six, 10},
+		{"empty word", []string{"a", "", "c", "d", "e", "f"}, 1},
+		{"tab in word", []string{"a", "b\tc", "c", "d", "e", "f"}, 1},
+	}
+	for _, tt := range tests {
+		if _, err := NewDictionary(tt.words, tt.dice); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+// singleByteSource reads r one byte per Byte call, the path
+// bufferedSource replaces.
+type singleByteSource struct {
+	r io.Reader
+}
+
+func (s singleByteSource) Byte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(s.r, b[:])
+	return b[0], err
+}
+
+func TestBufferedSourceMatchesSingleByte(t *testing.T) {
+	stream := make([]byte, 64*1024)
+	if _, err := rand.Read(stream); err != nil {
+		t.Fatal(err)
+	}
+	buffered := ReaderSource(bytes.NewReader(stream))
+	single := singleByteSource{bytes.NewReader(stream)}
+	for i := 0; i < 5000; i++ {
+		a, err := generateDicewareNumber(context.Background(), buffered, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := generateDicewareNumber(context.Background(), single, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != b {
+			t.Fatalf("number %d: buffered %d, single-byte %d", i, a, b)
+		}
+	}
+}
+
+func benchmarkDice(b *testing.B, src RandSource) {
+	for i := 0; i < b.N; i++ {
+		if _, err := generateDicewareNumber(context.Background(), src, 5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDiceBuffered(b *testing.B) {
+	benchmarkDice(b, ReaderSource(rand.Reader))
+}
+
+func BenchmarkDiceSingleByte(b *testing.B) {
+	benchmarkDice(b, singleByteSource{rand.Reader})
+}
+
+// reinholdExcerpt is laid out like the original Diceware list as
+// downloaded: PGP armor around CRLF lines, with the kinds of odd entries
+// it has, such as "!", numbers and "a&p".
+const reinholdExcerpt = "-----BEGIN PGP SIGNED MESSAGE-----\r\n" +
+	"Hash: SHA1\r\n" +
+	"\r\n" +
+	"11111\ta\r\n" +
+	"11112\ta&p\r\n" +
+	"11113\t's\r\n" +
+	"11114\t1\r\n" +
+	"11115\t10\r\n" +
+	"66664\t@\r\n" +
+	"66665\t!\r\n" +
+	"66666\t?\r\n" +
+	"-----BEGIN PGP SIGNATURE-----\r\n" +
+	"Version: GnuPG v1\r\n" +
+	"\r\n" +
+	"iQCVAwUBOdQ0gRssVj8C6uLmAQH+xQP/\r\n" +
+	"=Qm1x\r\n" +
+	"-----END PGP SIGNATURE-----\r\n"
+
+func TestReinholdEntries(t *testing.T) {
+	dict := parseList(t, reinholdExcerpt, false)
+	want := map[int]string{11111: "a", 11112: "a&p", 11113: "'s", 11114: "1", 11115: "10", 66664: "@", 66665: "!", 66666: "?"}
+	if !maps.Equal(dict.Words, want) {
+		t.Errorf("got %v, want %v", dict.Words, want)
+	}
+	if dict.Dice != 5 || dict.InvalidKeys != 0 {
+		t.Errorf("got %d dice and %d invalid keys, want 5 and 0", dict.Dice, dict.InvalidKeys)
+	}
+}
+
+func TestReinholdTransforms(t *testing.T) {
+	words := []string{"a&p", "!", "1", "'s", "@"}
+	tests := []struct {
+		name                     string
+		capitalize, boundaryCase bool
+		want                     string
+	}{
+		{"capitalize", true, false, "A&P!1's@"},
+		{"boundary case", false, true, "a&p!1's@"},
+		{"none", false, false, "a&p!1's@"},
+	}
+	for _, tt := range tests {
+		// -s "" joins the words directly
+		gen := &Generator{Transform: wordTransform(language.English, tt.capitalize, tt.boundaryCase)}
+		if got := gen.FromWords(words).Text; got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStreamListingMatchesGenerate(t *testing.T) {
+	words := make([]string, 36)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", i)
+	}
+	dict, err := NewDictionary(words, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := make([]byte, 4096)
+	if _, err := rand.Read(stream); err != nil {
+		t.Fatal(err)
+	}
+	// Re-roll every word ending in 7, so the re-roll counts are exercised
+	accept := func(word string) bool { return !strings.HasSuffix(word, "7") }
+	newGen := func() *Generator {
+		return &Generator{Source: ReaderSource(bytes.NewReader(stream)), Dict: dict, Dice: 2, Pool: 35,
+			Accept: accept, MaxRetries: 100, Transform: func(i int, word string) string { return word }}
+	}
+
+	p, err := newGen().Generate(context.Background(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int
+	rerolls, most, entropy, err := streamListing(context.Background(), newGen(), 200, func(i, number int) {
+		if i != len(numbers) {
+			t.Fatalf("number %d emitted as %d", len(numbers), i)
+		}
+		numbers = append(numbers, number)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(numbers, p.Numbers) {
+		t.Error("streamed numbers differ from the generated ones")
+	}
+	if rerolls != p.Rerolls || most != p.MostRerolls {
+		t.Errorf("re-rolls %d, at most %d; want %d, at most %d", rerolls, most, p.Rerolls, p.MostRerolls)
+	}
+	if want := newGen().Entropy(p); math.Abs(entropy-want) > 1e-9 {
+		t.Errorf("entropy %.3f, want %.3f", entropy, want)
+	}
+}
+
+func TestMinimalPassphrase(t *testing.T) {
+	words := make([]string, 36)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", i)
+	}
+	dict, err := NewDictionary(words, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newGen := func(policy func(p *Passphrase) bool) *Generator {
+		return &Generator{Source: ReaderSource(rand.Reader), Dict: dict, Dice: 2, Pool: 36, MaxRetries: 100,
+			Accept:    func(word string) bool { return true },
+			Transform: func(i int, word string) string { return word }, Separator: "-", Policy: policy}
+	}
+	tests := []struct {
+		name    string
+		minBits float64
+		policy  func(p *Passphrase) bool
+		want    int
+	}{
+		// 5.17 bits per word
+		{"bits", 20, nil, 4},
+		{"exact bits", Entropy(36, 3), nil, 3},
+		{"policy", 0, func(p *Passphrase) bool { return len(p.Text) >= 20 }, 6},
+		{"both", 10, func(p *Passphrase) bool { return len(p.Words) >= 5 }, 5},
+	}
+	for _, tt := range tests {
+		p, err := minimalPassphrase(context.Background(), newGen(tt.policy), tt.minBits, 100)
+		if err != nil || p == nil {
+			t.Fatalf("%s: got %v, %v", tt.name, p, err)
+		}
+		if len(p.Numbers) != tt.want {
+			t.Errorf("%s: %d words, want %d", tt.name, len(p.Numbers), tt.want)
+		}
+	}
+	never := func(p *Passphrase) bool { return false }
+	if p, err := minimalPassphrase(context.Background(), newGen(never), 0, 3); p != nil || err != nil {
+		t.Errorf("unsatisfiable policy: got %v, %v", p, err)
+	}
+}
+
+func TestEncryptFileFreshHeader(t *testing.T) {
+	dir := t.TempDir()
+	in := dir + "/plain"
+	if err := os.WriteFile(in, []byte("attack at dawn"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var headers [][]byte
+	for _, name := range []string{"a", "b"} {
+		out := dir + "/" + name
+		if err := encryptFile(in, out, "correct horse"); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, data[:encryptHeader])
+		if err := decryptFile(out, out+".plain", []byte("correct horse")); err != nil {
+			t.Fatal(err)
+		}
+		if plain, _ := os.ReadFile(out + ".plain"); string(plain) != "attack at dawn" {
+			t.Errorf("decrypted %q", plain)
+		}
+	}
+	if bytes.Equal(headers[0], headers[1]) {
+		t.Error("two encryptions with the same passphrase share a salt and nonce")
+	}
+}
+
+func TestServeMinBits(t *testing.T) {
+	words := make([]string, 36)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", i)
+	}
+	dict, err := NewDictionary(words, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := &Generator{Source: ReaderSource(rand.Reader), Dict: dict, Dice: 2, Pool: 36, MaxRetries: 100,
+		Accept:    func(word string) bool { return true },
+		Transform: func(i int, word string) string { return word }, Separator: "-"}
+	handler := passphraseHandler(gen, 6, 100, 20, "crypto/rand", nil, nil)
+	// 5.17 bits per word
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusOK},
+		{"?words=1", http.StatusBadRequest},
+		{"?words=3", http.StatusBadRequest},
+		{"?words=4", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/passphrase"+tt.query, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%q: status %d, want %d", tt.query, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+//go:build tpm
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeTPM answers GetRandom with at most short bytes per call, counting
+// up from 0, or with nothing once empty calls have been made.
+type fakeTPM struct {
+	short int // largest answer, 0 for no limit
+	empty int // calls after which it returns no bytes, 0 for never
+	calls int
+	next  byte
+	delay time.Duration // time each call takes, like a command round trip
+}
+
+func (f *fakeTPM) GetRandom(ctx context.Context, n uint16) ([]byte, error) {
+	f.calls++
+	time.Sleep(f.delay)
+	if f.empty > 0 && f.calls > f.empty {
+		return nil, nil
+	}
+	if f.short > 0 && int(n) > f.short {
+		n = uint16(f.short)
+	}
+	random := make([]byte, n)
+	for i := range random {
+		random[i] = f.next
+		f.next++
+	}
+	return random, nil
+}
+
+func TestTPMReaderShortReads(t *testing.T) {
+	tpm := &fakeTPM{short: 3}
+	r := &tpmReader{ctx: context.Background(), tpm: tpm, batch: 8}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !bytes.Equal(buf, want) {
+		t.Errorf("read %v, want %v", buf, want)
+	}
+	if tpm.calls != 4 {
+		t.Errorf("made %d GetRandom calls, want 4", tpm.calls)
+	}
+}
+
+func TestTPMReaderBatch(t *testing.T) {
+	tpm := &fakeTPM{}
+	r := &tpmReader{ctx: context.Background(), tpm: tpm, batch: 4}
+	n, err := r.Read(make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("Read returned %d bytes, want at most the batch of 4", n)
+	}
+}
+
+func TestTPMReaderEmpty(t *testing.T) {
+	tpm := &fakeTPM{short: 2, empty: 2}
+	src := newBufferedSource(&tpmReader{ctx: context.Background(), tpm: tpm, batch: 8}, 8)
+	if _, err := src.Byte(); err == nil || err.Error() != "TPM returned no random bytes" {
+		t.Fatalf("got error %v, want the empty TPM answer reported", err)
+	}
+	if tpm.calls != 3 {
+		t.Errorf("made %d GetRandom calls, want 3", tpm.calls)
+	}
+}
+
+func TestTPMReaderCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &tpmReader{ctx: ctx, tpm: &fakeTPM{}, batch: 8, delay: time.Hour}
+	r.last = time.Now()
+	if _, err := r.Read(make([]byte, 8)); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+// BenchmarkTPMBatch reads 1024 bytes from a TPM that takes 20µs per call
+// and returns at most 32 bytes, as many do, for several -tpm-batch sizes.
+func BenchmarkTPMBatch(b *testing.B) {
+	for _, batch := range []int{1, 8, 16, 32, 48, 64} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			tpm := &fakeTPM{short: 32, delay: 20 * time.Microsecond}
+			src := newBufferedSource(&tpmReader{ctx: context.Background(), tpm: tpm, batch: batch}, batch)
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 1024; j++ {
+					if _, err := src.Byte(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}